@@ -0,0 +1,226 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+)
+
+const (
+	HeaderForwardedFor   = "X-Forwarded-For"
+	HeaderRealIP         = "X-Real-Ip"
+	HeaderCFConnectingIP = "Cf-Connecting-Ip"
+	HeaderForwarded      = "Forwarded"
+)
+
+var (
+	resolver = &Resolver{}
+)
+
+// Resolver determines the address of the client of a request. Headers set by proxies are
+// only used when the request comes from one of the trusted proxies.
+type Resolver struct {
+	proxies []netip.Prefix
+	headers []string
+}
+
+// NewResolver 创建客户端地址解析器。proxies 为可信代理的地址或 CIDR，
+// headers 为按顺序检查的可信请求头
+func NewResolver(proxies, headers []string) (*Resolver, error) {
+	var r Resolver
+
+	for _, p := range proxies {
+		prefix, err := parsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		r.proxies = append(r.proxies, prefix)
+	}
+
+	for _, h := range headers {
+		h = textproto.CanonicalMIMEHeaderKey(h)
+		switch h {
+		case HeaderForwardedFor, HeaderRealIP, HeaderCFConnectingIP, HeaderForwarded:
+		default:
+			return nil, fmt.Errorf("unsupported header %q", h)
+		}
+		r.headers = append(r.headers, h)
+	}
+
+	return &r, nil
+}
+
+// Initialize 根据 trusted_proxies 和 trusted_headers 创建全局解析器
+func Initialize(conf *config.Config) {
+	r, err := NewResolver(conf.TrustedProxies, conf.TrustedHeaders)
+	if err != nil {
+		log.Fatalf("Error parsing trusted proxy settings: %s", err)
+	}
+	if len(r.proxies) > 0 {
+		log.Infof("Trusting %v from proxies %v", r.headers, r.proxies)
+	}
+	resolver = r
+}
+
+// FromRequest 使用全局解析器返回请求的客户端地址
+func FromRequest(req *http.Request) netip.Addr {
+	return resolver.Resolve(req)
+}
+
+// ClientIP 与 FromRequest 相同，但返回字符串形式，无法确定地址时返回空字符串
+func ClientIP(req *http.Request) string {
+	addr := FromRequest(req)
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
+// ProxyPolicy 决定是否信任 PROXY protocol 头部。未配置可信代理时信任所有连接，
+// 否则只接受来自可信代理的 PROXY protocol 头部
+func ProxyPolicy(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+	if len(resolver.proxies) == 0 {
+		return proxyproto.USE, nil
+	}
+	addr, err := netip.ParseAddrPort(opts.Upstream.String())
+	if err != nil || !resolver.Trusted(addr.Addr()) {
+		return proxyproto.REJECT, nil
+	}
+	return proxyproto.USE, nil
+}
+
+// HasTrustedProxies reports whether any trusted proxies are configured
+func HasTrustedProxies() bool {
+	return len(resolver.proxies) > 0
+}
+
+// Trusted reports whether addr belongs to a trusted proxy
+func (r *Resolver) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, p := range r.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve 返回请求的客户端地址。直接连接的对端不是可信代理时返回对端地址，
+// 否则按顺序使用第一个包含有效地址的可信请求头
+func (r *Resolver) Resolve(req *http.Request) netip.Addr {
+	peer, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		// e.g. connections accepted on a unix socket
+		return netip.Addr{}
+	}
+	addr := peer.Addr().Unmap().WithZone("")
+
+	if !r.Trusted(addr) {
+		return addr
+	}
+
+	for _, h := range r.headers {
+		values := req.Header.Values(h)
+		if len(values) == 0 {
+			continue
+		}
+
+		var client netip.Addr
+		switch h {
+		case HeaderForwardedFor:
+			client = r.lastUntrusted(splitList(values))
+		case HeaderForwarded:
+			client = r.lastUntrusted(forwardedFor(values))
+		default:
+			client = parseAddr(values[0])
+		}
+		if client.IsValid() {
+			return client
+		}
+	}
+
+	return addr
+}
+
+// lastUntrusted 从右往左跳过可信代理，返回第一个不可信的地址。
+// 遇到无效地址时停止，所有地址都可信时返回最左边的地址
+func (r *Resolver) lastUntrusted(hops []string) netip.Addr {
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr := parseAddr(hops[i])
+		if !addr.IsValid() {
+			break
+		}
+		client = addr
+		if !r.Trusted(addr) {
+			break
+		}
+	}
+	return client
+}
+
+func splitList(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// forwardedFor 返回 RFC 7239 Forwarded 头部中各个 for 参数的值
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		var node string
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				node = strings.Trim(value, `"`)
+			}
+		}
+		hops = append(hops, node)
+	}
+	return hops
+}
+
+// parseAddr 解析可能带有端口或方括号的地址，无效时返回零值
+func parseAddr(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap().WithZone("")
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap().WithZone("")
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return prefix, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,154 @@
+package clientip
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	r, err := NewResolver(
+		[]string{"10.0.0.0/8", "2001:db8::1"},
+		[]string{"x-forwarded-for", "Forwarded", "X-Real-IP"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{
+			name:       "untrusted peer ignores headers",
+			remoteAddr: "203.0.113.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.1:5000",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "client before trusted proxy",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.5, 10.0.0.2"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "spoofed hops left of the client are ignored",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.5, 10.1.1.1"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "header lines are joined",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.9", "10.0.0.2"}},
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "all hops trusted returns the leftmost",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "walk stops at an invalid hop",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"203.0.113.5, unknown, 10.0.0.2"}},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "hops with ports",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"[2001:db8:cafe::17]:4711, 10.0.0.2:80"}},
+			want:       "2001:db8:cafe::17",
+		},
+		{
+			name:       "forwarded for parameters",
+			remoteAddr: "[2001:db8::1]:5000",
+			header:     http.Header{"Forwarded": {`for=198.51.100.1;proto=http, for="[2001:db8:cafe::17]:4711";by=10.0.0.2`}},
+			want:       "2001:db8:cafe::17",
+		},
+		{
+			name:       "invalid header falls through to the next one",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"unknown"}, "X-Real-Ip": {"203.0.113.7"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "untrusted header is not used",
+			remoteAddr: "10.0.0.1:5000",
+			header:     http.Header{"Cf-Connecting-Ip": {"203.0.113.7"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "mapped peer address",
+			remoteAddr: "[::ffff:10.0.0.1]:5000",
+			header:     http.Header{"X-Real-Ip": {"::ffff:203.0.113.8"}},
+			want:       "203.0.113.8",
+		},
+		{
+			name:       "unix socket peer",
+			remoteAddr: "@",
+			header:     http.Header{"X-Real-Ip": {"203.0.113.8"}},
+			want:       "invalid IP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+			if got := r.Resolve(req); got.String() != tt.want {
+				t.Errorf("Resolve() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	tests := []struct {
+		proxies, headers []string
+		wantErr          bool
+	}{
+		{[]string{"10.0.0.0/8", "192.0.2.1", "::ffff:192.0.2.2"}, []string{"X-Forwarded-For"}, false},
+		{[]string{"10.0.0.0/33"}, nil, true},
+		{[]string{"proxy.example.com"}, nil, true},
+		{nil, []string{"X-Client-IP"}, true},
+	}
+	for _, tt := range tests {
+		_, err := NewResolver(tt.proxies, tt.headers)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewResolver(%v, %v) error = %v, want error %v", tt.proxies, tt.headers, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	r, err := NewResolver([]string{"10.1.2.3/8", "192.0.2.1", "::ffff:198.51.100.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		// host bits of the configured prefix are masked
+		{"10.200.0.1", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"::ffff:192.0.2.1", true},
+		{"198.51.100.1", true},
+		{"fe80::1%eth0", false},
+	}
+	for _, tt := range tests {
+		if got := r.Trusted(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Trusted(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// overheadCompensationFactor is applied to download and upload speeds, the same as speedtest_worker.js does
+	overheadCompensationFactor = 1.06
+	// uploadSize is the size of the body of a single upload request
+	uploadSize = 20 * 1048576
+	// streamDelay staggers the start of the streams so that they do not end at the same time
+	streamDelay = 300 * time.Millisecond
+)
+
+var (
+	// uploadData is sent by all upload streams
+	uploadData = make([]byte, 1048576)
+)
+
+func init() {
+	rand.Read(uploadData)
+}
+
+// ipInfo is the response of /getIP
+type ipInfo struct {
+	ProcessedString string          `json:"processedString"`
+	RawISPInfo      json.RawMessage `json:"rawIspInfo"`
+}
+
+// Client runs tests against a single server
+type Client struct {
+	// BaseURL is the URL the endpoints are relative to, e.g. http://localhost:8989/backend
+	BaseURL string
+	HTTP    *http.Client
+	// Timeout bounds the requests of the IP lookup, the ping test and the result submission
+	Timeout time.Duration
+}
+
+// RateLimitError is returned when the server rejects a test with 429 Too Many Requests
+type RateLimitError struct {
+	RetryAfter string
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limited by the server, retry after " + e.RetryAfter + " seconds"
+}
+
+// endpoint 返回端点的完整 URL，附加随机参数避免缓存
+func (c *Client) endpoint(path string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("r", strconv.FormatFloat(mrand.Float64(), 'f', -1, 64))
+	return strings.TrimRight(c.BaseURL, "/") + path + "?" + query.Encode()
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		resp.Body.Close()
+		return nil, &RateLimitError{RetryAfter: resp.Header.Get("Retry-After")}
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// GetIP 请求 /getIP，返回服务器看到的客户端地址及其信息
+func (c *Client) GetIP(ctx context.Context, isp bool) (ipInfo, error) {
+	var info ipInfo
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	query := url.Values{}
+	if isp {
+		query.Set("isp", "true")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/getIP", query), nil)
+	if err != nil {
+		return info, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// Ping 依次向 /empty 发送 count 个请求，返回最低延迟和抖动（毫秒）。
+// 延迟取请求发送完成到收到第一个响应字节的时间，第一个请求用于建立连接，不计入结果
+func (c *Client) Ping(ctx context.Context, count int) (ping, jitter float64, err error) {
+	var rtts []float64
+	for i := 0; i <= count; i++ {
+		rtt, err := c.ping(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if i > 0 {
+			rtts = append(rtts, float64(rtt)/float64(time.Millisecond))
+		}
+	}
+
+	// same calculation as speedtest_worker.js, spikes are given more weight
+	for i, rtt := range rtts {
+		if i == 0 {
+			ping = rtt
+			continue
+		}
+		ping = math.Min(ping, rtt)
+		d := math.Abs(rtt - rtts[i-1])
+		switch {
+		case i == 1:
+			jitter = d
+		case d > jitter:
+			jitter = jitter*0.3 + d*0.7
+		default:
+			jitter = jitter*0.8 + d*0.2
+		}
+	}
+	return ping, jitter, nil
+}
+
+func (c *Client) ping(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	var wrote, firstByte time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/empty", nil), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return firstByte.Sub(wrote), nil
+}
+
+// Download 使用 streams 个并发请求从 /garbage 下载数据，grace 之后开始计量，持续 duration，返回速度（Mbit/s）
+func (c *Client) Download(ctx context.Context, streams, chunks int, grace, duration time.Duration) (float64, int64, error) {
+	query := url.Values{"ckSize": {strconv.Itoa(chunks)}}
+	return c.measure(ctx, streams, grace, duration, func(ctx context.Context, loaded *atomic.Int64) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/garbage", query), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		_, err = io.Copy(io.Discard, &countingReader{r: resp.Body, n: loaded})
+		return err
+	})
+}
+
+// Upload 使用 streams 个并发请求向 /empty 上传数据，grace 之后开始计量，持续 duration，返回速度（Mbit/s）
+func (c *Client) Upload(ctx context.Context, streams int, grace, duration time.Duration) (float64, int64, error) {
+	return c.measure(ctx, streams, grace, duration, func(ctx context.Context, loaded *atomic.Int64) error {
+		body := &countingReader{r: &repeatReader{data: uploadData, left: uploadSize}, n: loaded}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint("/empty", nil), body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = uploadSize
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil
+	})
+}
+
+// measure 启动 streams 个并发的测试流，每个流在请求结束后立即开始下一个请求，直到测试结束。
+// 与 speedtest_worker.js 相同，grace 期间传输的数据不计入速度
+func (c *Client) measure(ctx context.Context, streams int, grace, duration time.Duration, request func(context.Context, *atomic.Int64) error) (float64, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		loaded atomic.Int64
+		wg     sync.WaitGroup
+		errMu  sync.Mutex
+		err    error
+	)
+	for i := 0; i < max(streams, 1); i++ {
+		wg.Add(1)
+		go func(delay time.Duration) {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			for ctx.Err() == nil {
+				rerr := request(ctx, &loaded)
+				if rerr == nil || ctx.Err() != nil {
+					continue
+				}
+				var rl *RateLimitError
+				if errors.As(rerr, &rl) {
+					errMu.Lock()
+					err = rerr
+					errMu.Unlock()
+					cancel()
+					return
+				}
+				// restart failed streams, like the browser client does by default
+				select {
+				case <-time.After(streamDelay):
+				case <-ctx.Done():
+				}
+			}
+		}(time.Duration(i) * streamDelay)
+	}
+
+	select {
+	case <-time.After(grace):
+	case <-ctx.Done():
+	}
+	start := time.Now()
+	offset := loaded.Load()
+
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
+	elapsed := time.Since(start)
+	n := loaded.Load() - offset
+	cancel()
+	wg.Wait()
+
+	if err != nil {
+		return 0, n, err
+	}
+	if n == 0 {
+		return 0, 0, errors.New("no data transferred")
+	}
+	return float64(n) * 8 * overheadCompensationFactor / 1e6 / elapsed.Seconds(), n, nil
+}
+
+// Submit 将测试结果提交到 /results/telemetry，返回服务器生成的测试 ID
+func (c *Client) Submit(ctx context.Context, r *Result, ip ipInfo, extra string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	if len(ip.RawISPInfo) == 0 {
+		ip.RawISPInfo = json.RawMessage(`{}`)
+	}
+	ispInfo, err := json.Marshal(ip)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"ispinfo": {string(ispInfo)},
+		"dl":      {formatMeasurement(r.Download)},
+		"ul":      {formatMeasurement(r.Upload)},
+		"ping":    {formatMeasurement(r.Ping)},
+		"jitter":  {formatMeasurement(r.Jitter)},
+		"log":     {""},
+		"extra":   {extra},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint("/results/telemetry", nil), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	id, ok := strings.CutPrefix(string(body), "id ")
+	if !ok {
+		return "", fmt.Errorf("unexpected response: %s", body)
+	}
+	return id, nil
+}
+
+// formatMeasurement formats a measurement with two decimals, like the browser client submits it
+func formatMeasurement(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// countingReader adds the bytes read to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// repeatReader returns data over and over until left bytes have been read
+type repeatReader struct {
+	data []byte
+	off  int
+	left int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.left)], r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	r.left -= n
+	return n, nil
+}
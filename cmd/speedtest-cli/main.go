@@ -0,0 +1,235 @@
+// Command speedtest-cli runs download, upload and ping tests against a speedtest server from the command line,
+// using the same endpoints as the browser client
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	userAgent = "speedtest-cli"
+
+	// grace times of the browser client, data transferred before is not measured because TCP windows are still growing
+	downloadGrace = 1500 * time.Millisecond
+	uploadGrace   = 3 * time.Second
+)
+
+var (
+	optServer    = flag.String("server", "http://localhost:8989/backend", "URL of the server's backend endpoints")
+	optDuration  = flag.Duration("duration", 15*time.Second, "duration of the download and upload tests each")
+	optDLStreams = flag.Int("dl-streams", 6, "number of concurrent download streams")
+	optULStreams = flag.Int("ul-streams", 3, "number of concurrent upload streams")
+	optChunks    = flag.Int("chunks", 100, "number of 1 MiB chunks requested per download stream")
+	optPings     = flag.Int("pings", 10, "number of pings in the ping test")
+	optTests     = flag.String("tests", "IPDU", "tests to run in order: I=IP, P=ping and jitter, D=download, U=upload")
+	optISP       = flag.Bool("isp", false, "ask the server for ISP information of the client address")
+	optFormat    = flag.String("format", "text", "output format: text, json or csv")
+	optNoHeader  = flag.Bool("no-header", false, "omit the header line of the csv output")
+	optSubmit    = flag.Bool("submit", false, "submit the results to the server's telemetry, to show up in /stats")
+	optExtra     = flag.String("extra", "", "extra data to submit with the results")
+	optTimeout   = flag.Duration("timeout", 10*time.Second, "timeout of the IP lookup, ping and result submission requests")
+	optInsecure  = flag.Bool("insecure", false, "skip verification of the server's TLS certificate")
+)
+
+// Result holds the results of a test run, speeds are in Mbit/s and times in milliseconds
+type Result struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Server        string    `json:"server"`
+	IP            string    `json:"ip,omitempty"`
+	Download      float64   `json:"download"`
+	Upload        float64   `json:"upload"`
+	Ping          float64   `json:"ping"`
+	Jitter        float64   `json:"jitter"`
+	DownloadBytes int64     `json:"download_bytes"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	// ID is the test ID returned by the server if the results were submitted
+	ID     string   `json:"id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+var (
+	csvHeader = []string{"timestamp", "server", "ip", "download", "upload", "ping", "jitter", "download_bytes", "upload_bytes", "id", "errors"}
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options]\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch *optFormat {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("Unknown output format %q", *optFormat)
+	}
+	if *optFormat != "text" {
+		// progress messages must not end up in machine-readable output
+		log.SetLevel(log.WarnLevel)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// allow every stream its own connection
+	transport.MaxIdleConnsPerHost = max(*optDLStreams, *optULStreams, 1)
+	// compressed responses would hide the actual transfer speed
+	transport.DisableCompression = true
+	if *optInsecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client := &Client{
+		BaseURL: *optServer,
+		HTTP:    &http.Client{Transport: transport},
+		Timeout: *optTimeout,
+	}
+
+	result, ip := run(ctx, client)
+	if ctx.Err() != nil {
+		log.Fatal("Interrupted")
+	}
+
+	if *optSubmit {
+		id, err := client.Submit(ctx, result, ip, *optExtra)
+		if err != nil {
+			result.Errors = append(result.Errors, "submit: "+err.Error())
+		} else {
+			result.ID = id
+		}
+	}
+
+	if err := write(os.Stdout, result); err != nil {
+		log.Fatalf("Error writing results: %s", err)
+	}
+	if len(result.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+// run 按 -tests 指定的顺序执行测试，失败的测试记录在结果的 Errors 中，不影响其余的测试
+func run(ctx context.Context, client *Client) (*Result, ipInfo) {
+	result := &Result{
+		Timestamp: time.Now().UTC(),
+		Server:    *optServer,
+	}
+	var ip ipInfo
+
+	fail := func(test string, err error) {
+		log.Errorf("%s test failed: %s", test, err)
+		result.Errors = append(result.Errors, strings.ToLower(test)+": "+err.Error())
+	}
+
+	for _, test := range strings.ToUpper(*optTests) {
+		if ctx.Err() != nil {
+			break
+		}
+
+		switch test {
+		case 'I':
+			info, err := client.GetIP(ctx, *optISP)
+			if err != nil {
+				fail("IP", err)
+				continue
+			}
+			ip = info
+			result.IP = info.ProcessedString
+			log.Infof("IP: %s", result.IP)
+		case 'P':
+			log.Infof("Running ping test with %d pings", *optPings)
+			ping, jitter, err := client.Ping(ctx, *optPings)
+			if err != nil {
+				fail("Ping", err)
+				continue
+			}
+			result.Ping, result.Jitter = ping, jitter
+			log.Infof("Ping: %.2f ms, jitter: %.2f ms", ping, jitter)
+		case 'D':
+			log.Infof("Running download test with %d streams for %s", *optDLStreams, *optDuration)
+			speed, n, err := client.Download(ctx, *optDLStreams, *optChunks, downloadGrace, *optDuration)
+			result.DownloadBytes = n
+			if err != nil {
+				fail("Download", err)
+				continue
+			}
+			result.Download = speed
+			log.Infof("Download: %.2f Mbit/s", speed)
+		case 'U':
+			log.Infof("Running upload test with %d streams for %s", *optULStreams, *optDuration)
+			speed, n, err := client.Upload(ctx, *optULStreams, uploadGrace, *optDuration)
+			result.UploadBytes = n
+			if err != nil {
+				fail("Upload", err)
+				continue
+			}
+			result.Upload = speed
+			log.Infof("Upload: %.2f Mbit/s", speed)
+		default:
+			log.Warnf("Ignoring unknown test %q", test)
+		}
+	}
+
+	return result, ip
+}
+
+// write 按 -format 指定的格式输出结果
+func write(w io.Writer, r *Result) error {
+	switch *optFormat {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if !*optNoHeader {
+			cw.Write(csvHeader)
+		}
+		cw.Write([]string{
+			r.Timestamp.Format(time.RFC3339),
+			r.Server,
+			r.IP,
+			formatMeasurement(r.Download),
+			formatMeasurement(r.Upload),
+			formatMeasurement(r.Ping),
+			formatMeasurement(r.Jitter),
+			strconv.FormatInt(r.DownloadBytes, 10),
+			strconv.FormatInt(r.UploadBytes, 10),
+			r.ID,
+			strings.Join(r.Errors, "; "),
+		})
+		cw.Flush()
+		return cw.Error()
+	default:
+		fmt.Fprintf(w, "Server:   %s\n", r.Server)
+		if r.IP != "" {
+			fmt.Fprintf(w, "IP:       %s\n", r.IP)
+		}
+		fmt.Fprintf(w, "Ping:     %.2f ms\n", r.Ping)
+		fmt.Fprintf(w, "Jitter:   %.2f ms\n", r.Jitter)
+		fmt.Fprintf(w, "Download: %.2f Mbit/s\n", r.Download)
+		fmt.Fprintf(w, "Upload:   %.2f Mbit/s\n", r.Upload)
+		if r.ID != "" {
+			fmt.Fprintf(w, "Test ID:  %s\n", r.ID)
+		}
+		for _, e := range r.Errors {
+			fmt.Fprintf(w, "Error:    %s\n", e)
+		}
+		return nil
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -14,23 +16,100 @@ type Config struct {
 	ServerLng         float64 `mapstructure:"server_lng"`
 	IPInfoAPIKey      string  `mapstructure:"ipinfo_api_key"`
 
+	GeoIPCityDatabase string `mapstructure:"geoip_city_database"`
+	GeoIPASNDatabase  string `mapstructure:"geoip_asn_database"`
+
+	IPInfoProviders        []string                 `mapstructure:"ipinfo_providers"`
+	IPInfoTimeout          time.Duration            `mapstructure:"ipinfo_timeout"`
+	IPInfoProviderTimeouts map[string]time.Duration `mapstructure:"ipinfo_provider_timeouts"`
+	IPInfoCacheSize        int                      `mapstructure:"ipinfo_cache_size"`
+	IPInfoCacheTTL         time.Duration            `mapstructure:"ipinfo_cache_ttl"`
+	IPAPIURL               string                   `mapstructure:"ipapi_url"`
+
+	IPLabels []IPLabel `mapstructure:"ip_labels"`
+
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	TrustedHeaders []string `mapstructure:"trusted_headers"`
+
+	RateLimitTestsPerMinute float64 `mapstructure:"ratelimit_tests_per_minute"`
+	RateLimitTestsBurst     int     `mapstructure:"ratelimit_tests_burst"`
+	RateLimitBytesPerSecond int64   `mapstructure:"ratelimit_bytes_per_second"`
+	RateLimitBytesBurst     int64   `mapstructure:"ratelimit_bytes_burst"`
+	RateLimitIPv6Prefix     int     `mapstructure:"ratelimit_ipv6_prefix"`
+
+	QuotaDailyBytes   int64  `mapstructure:"quota_daily_bytes"`
+	QuotaMonthlyBytes int64  `mapstructure:"quota_monthly_bytes"`
+	QuotaBytesPerTest int64  `mapstructure:"quota_bytes_per_test"`
+	QuotaIPv4Prefix   int    `mapstructure:"quota_ipv4_prefix"`
+	QuotaIPv6Prefix   int    `mapstructure:"quota_ipv6_prefix"`
+	QuotaTimezone     string `mapstructure:"quota_timezone"`
+
+	DownloadChunks    int `mapstructure:"download_chunks"`
+	DownloadChunkSize int `mapstructure:"download_chunk_size"`
+	DownloadMaxChunks int `mapstructure:"download_max_chunks"`
+
+	TestFiles []string `mapstructure:"test_files"`
+
+	MeasurementSessionTimeout time.Duration `mapstructure:"measurement_session_timeout"`
+	MeasurementTolerance      float64       `mapstructure:"measurement_tolerance"`
+
+	Servers             []Server      `mapstructure:"servers"`
+	ServerProbeInterval time.Duration `mapstructure:"server_probe_interval"`
+	ServerProbeTimeout  time.Duration `mapstructure:"server_probe_timeout"`
+
 	StatsPassword string `mapstructure:"statistics_password"`
 	RedactIP      bool   `mapstructure:"redact_ip_addresses"`
 
 	AssetsPath string `mapstructure:"assets_path"`
 
+	ShutdownGracePeriod time.Duration `mapstructure:"shutdown_grace_period"`
+
+	EnableMetrics bool `mapstructure:"enable_metrics"`
+
 	DatabaseType     string `mapstructure:"database_type"`
 	DatabaseHostname string `mapstructure:"database_hostname"`
 	DatabaseName     string `mapstructure:"database_name"`
 	DatabaseUsername string `mapstructure:"database_username"`
 	DatabasePassword string `mapstructure:"database_password"`
 
+	DatabaseAutoMigrate bool `mapstructure:"database_auto_migrate"`
+
+	RetentionMaxAge     time.Duration `mapstructure:"retention_max_age"`
+	RetentionMaxRecords int           `mapstructure:"retention_max_records"`
+	RetentionInterval   time.Duration `mapstructure:"retention_interval"`
+
 	DatabaseFile string `mapstructure:"database_file"`
 
 	EnableHTTP2 bool   `mapstructure:"enable_http2"`
 	EnableTLS   bool   `mapstructure:"enable_tls"`
 	TLSCertFile string `mapstructure:"tls_cert_file"`
 	TLSKeyFile  string `mapstructure:"tls_key_file"`
+
+	EnableACME          bool     `mapstructure:"enable_acme"`
+	ACMEDomains         []string `mapstructure:"acme_domains"`
+	ACMEEmail           string   `mapstructure:"acme_email"`
+	ACMECacheDir        string   `mapstructure:"acme_cache_dir"`
+	ACMEDirectoryURL    string   `mapstructure:"acme_directory_url"`
+	ACMEDirectoryCAFile string   `mapstructure:"acme_directory_ca_file"`
+}
+
+// IPLabel names the network of the clients in CIDR
+type IPLabel struct {
+	CIDR  string `mapstructure:"cidr"`
+	Label string `mapstructure:"label"`
+}
+
+// Server is an entry of the server list for the multiple servers frontends
+type Server struct {
+	Name        string  `mapstructure:"name"`
+	Server      string  `mapstructure:"server"`
+	DownloadURL string  `mapstructure:"dl_url"`
+	UploadURL   string  `mapstructure:"ul_url"`
+	PingURL     string  `mapstructure:"ping_url"`
+	GetIPURL    string  `mapstructure:"getip_url"`
+	Location    string  `mapstructure:"location"`
+	Lat         float64 `mapstructure:"lat"`
+	Lng         float64 `mapstructure:"lng"`
 }
 
 var (
@@ -43,16 +122,47 @@ func init() {
 	viper.SetDefault("url_base", "")
 	viper.SetDefault("proxyprotocol_port", "0")
 	viper.SetDefault("download_chunks", 4)
+	viper.SetDefault("download_chunk_size", 1048576)
+	viper.SetDefault("download_max_chunks", 1024)
+	viper.SetDefault("test_files", []string{"100MB", "1GB"})
 	viper.SetDefault("distance_unit", "K")
 	viper.SetDefault("enable_cors", false)
+	viper.SetDefault("trusted_headers", []string{"X-Forwarded-For"})
+	viper.SetDefault("ratelimit_tests_per_minute", 0)
+	viper.SetDefault("ratelimit_tests_burst", 30)
+	viper.SetDefault("ratelimit_bytes_per_second", 0)
+	viper.SetDefault("ratelimit_bytes_burst", 2147483648)
+	viper.SetDefault("ratelimit_ipv6_prefix", 64)
+	viper.SetDefault("quota_daily_bytes", 0)
+	viper.SetDefault("quota_monthly_bytes", 0)
+	viper.SetDefault("quota_bytes_per_test", 268435456)
+	viper.SetDefault("quota_ipv4_prefix", 32)
+	viper.SetDefault("quota_ipv6_prefix", 64)
+	viper.SetDefault("quota_timezone", "UTC")
+	viper.SetDefault("measurement_session_timeout", "1m")
+	viper.SetDefault("measurement_tolerance", 0.5)
+	viper.SetDefault("server_probe_interval", "30s")
+	viper.SetDefault("server_probe_timeout", "5s")
+	viper.SetDefault("ipinfo_timeout", "2s")
+	viper.SetDefault("ipinfo_cache_size", 10000)
+	viper.SetDefault("ipinfo_cache_ttl", "1h")
+	viper.SetDefault("ipapi_url", "http://ip-api.com/json/{ip}")
+	viper.SetDefault("shutdown_grace_period", "30s")
+	viper.SetDefault("enable_metrics", false)
 	viper.SetDefault("statistics_password", "PASSWORD")
 	viper.SetDefault("redact_ip_addresses", false)
 	viper.SetDefault("database_type", "postgresql")
 	viper.SetDefault("database_hostname", "localhost")
 	viper.SetDefault("database_name", "speedtest")
 	viper.SetDefault("database_username", "postgres")
+	viper.SetDefault("database_auto_migrate", true)
+	viper.SetDefault("retention_max_age", "0s")
+	viper.SetDefault("retention_max_records", 0)
+	viper.SetDefault("retention_interval", "1h")
 	viper.SetDefault("enable_tls", false)
 	viper.SetDefault("enable_http2", false)
+	viper.SetDefault("enable_acme", false)
+	viper.SetDefault("acme_cache_dir", "acme-cache")
 
 	viper.SetConfigName("settings")
 	viper.AddConfigPath(".")
@@ -1,18 +1,23 @@
 package bolt
 
 import (
+	"encoding/binary"
 	"encoding/json"
-	"errors"
+	"strings"
 	"time"
 
 	"speedtest/database/schema"
 
+	"github.com/oklog/ulid/v2"
 	log "github.com/sirupsen/logrus"
 	"go.etcd.io/bbolt"
 )
 
 const (
 	bucketName = `speedtest`
+	// usageBucketName holds the quota counters, keyed by client and period separated by usageKeySeparator
+	usageBucketName   = `speedtest_quota`
+	usageKeySeparator = "|"
 )
 
 type Bolt struct {
@@ -44,39 +49,191 @@ func (p *Bolt) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 	err := p.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketName))
 		if bucket == nil {
-			return errors.New("data bucket doesn't exist yet")
+			return schema.ErrNotFound
 		}
 		b := bucket.Get([]byte(uuid))
+		if b == nil {
+			return schema.ErrNotFound
+		}
 		return json.Unmarshal(b, &record)
 	})
 	return &record, err
 }
 
-func (p *Bolt) FetchLast100() ([]schema.TelemetryData, error) {
+func (p *Bolt) Query(q schema.Query) (*schema.Page, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
 	var records []schema.TelemetryData
-	err := p.db.View(func(tx *bbolt.Tx) error {
-		var record schema.TelemetryData
+	err = p.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketName))
 		if bucket == nil {
-			return errors.New("data bucket doesn't exist yet")
+			return nil
 		}
 
+		// keys are test IDs, which sort in the order the tests were recorded
 		cursor := bucket.Cursor()
-		_, b := cursor.Last()
+		var k, b []byte
+		next := cursor.Prev
+		switch {
+		case q.Order == schema.OldestFirst && q.Cursor != "":
+			k, b = cursor.Seek([]byte(q.Cursor))
+			next = cursor.Next
+		case q.Order == schema.OldestFirst:
+			k, b = cursor.First()
+			next = cursor.Next
+		case q.Cursor != "":
+			k, b = cursor.Seek([]byte(q.Cursor))
+			if k == nil {
+				k, b = cursor.Last()
+			}
+		default:
+			k, b = cursor.Last()
+		}
 
-		for len(records) < 100 {
+		for ; k != nil && len(records) <= q.Limit; k, b = next() {
+			if !q.AfterCursor(string(k)) {
+				continue
+			}
+			var record schema.TelemetryData
 			if err := json.Unmarshal(b, &record); err != nil {
 				return err
 			}
-			records = append(records, record)
+			if q.Match(&record) {
+				records = append(records, record)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.NewPage(records), nil
+}
 
-			_, b = cursor.Prev()
-			if b == nil {
-				break
+func (p *Bolt) Purge(maxAge time.Duration, maxRecords int) (int64, error) {
+	var deleted int64
+	err := p.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		excess := 0
+		if maxRecords > 0 {
+			excess = bucket.Stats().KeyN - maxRecords
+		}
+		cutoff := time.Now().Add(-maxAge)
+
+		// keys are test IDs, which sort in the order the tests were recorded, so the expired
+		// records come first. Deleting while iterating skips keys in bbolt, so collect the keys first
+		var expired [][]byte
+		cursor := bucket.Cursor()
+		for k, b := cursor.First(); k != nil; k, b = cursor.Next() {
+			if len(expired) >= excess {
+				if maxAge <= 0 {
+					break
+				}
+				recorded, err := recordTime(k, b)
+				if err != nil {
+					return err
+				}
+				if !recorded.Before(cutoff) {
+					break
+				}
 			}
+			expired = append(expired, append([]byte(nil), k...))
 		}
 
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = int64(len(expired))
 		return nil
 	})
-	return records, err
+	return deleted, err
+}
+
+// recordTime 返回记录的时间，优先使用作为键的 ULID 中的时间戳，避免解码记录
+func recordTime(key, value []byte) (time.Time, error) {
+	if id, err := ulid.ParseStrict(string(key)); err == nil {
+		return ulid.Time(id.Time()), nil
+	}
+
+	var record schema.TelemetryData
+	if err := json.Unmarshal(value, &record); err != nil {
+		return time.Time{}, err
+	}
+	return record.Timestamp, nil
+}
+
+func (p *Bolt) AddUsage(client, period string, bytes int64) error {
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(usageBucketName))
+		if err != nil {
+			return err
+		}
+		key := []byte(client + usageKeySeparator + period)
+		var value [8]byte
+		if b := bucket.Get(key); len(b) == len(value) {
+			bytes += int64(binary.BigEndian.Uint64(b))
+		}
+		binary.BigEndian.PutUint64(value[:], uint64(bytes))
+		return bucket.Put(key, value[:])
+	})
+}
+
+func (p *Bolt) Usage(client, period string) (int64, error) {
+	var bytes int64
+	err := p.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(usageBucketName))
+		if bucket == nil {
+			return nil
+		}
+		if b := bucket.Get([]byte(client + usageKeySeparator + period)); len(b) == 8 {
+			bytes = int64(binary.BigEndian.Uint64(b))
+		}
+		return nil
+	})
+	return bytes, err
+}
+
+func (p *Bolt) PurgeUsage(before string) (int64, error) {
+	var deleted int64
+	err := p.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(usageBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		var expired [][]byte
+		err := bucket.ForEach(func(k, _ []byte) error {
+			key := string(k)
+			if key[strings.LastIndex(key, usageKeySeparator)+1:] < before {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = int64(len(expired))
+		return nil
+	})
+	return deleted, err
+}
+
+func (p *Bolt) Close() error {
+	return p.db.Close()
 }
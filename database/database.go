@@ -1,6 +1,8 @@
 package database
 
 import (
+	"time"
+
 	"speedtest/config"
 	"speedtest/database/bolt"
 	"speedtest/database/memory"
@@ -8,6 +10,7 @@ import (
 	"speedtest/database/none"
 	"speedtest/database/postgresql"
 	"speedtest/database/schema"
+	"speedtest/database/sqlite"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -19,7 +22,21 @@ var (
 type DataAccess interface {
 	Insert(*schema.TelemetryData) error
 	FetchByUUID(string) (*schema.TelemetryData, error)
-	FetchLast100() ([]schema.TelemetryData, error)
+	Query(schema.Query) (*schema.Page, error)
+	// Purge deletes records older than maxAge and all but the newest maxRecords records,
+	// a zero value disables the respective limit. It returns the number of deleted records.
+	Purge(maxAge time.Duration, maxRecords int) (int64, error)
+	// AddUsage adds bytes to the transfer counter of a client in a quota period, Usage returns
+	// the counter. PurgeUsage deletes the counters of all periods that sort before the given one.
+	AddUsage(client, period string, bytes int64) error
+	Usage(client, period string) (int64, error)
+	PurgeUsage(before string) (int64, error)
+	Close() error
+}
+
+// Migrator is implemented by backends that manage their own schema.
+type Migrator interface {
+	Migrate() error
 }
 
 func SetDBInfo(conf *config.Config) {
@@ -30,11 +47,28 @@ func SetDBInfo(conf *config.Config) {
 		DB = mysql.Open(conf.DatabaseHostname, conf.DatabaseUsername, conf.DatabasePassword, conf.DatabaseName)
 	case "bolt":
 		DB = bolt.Open(conf.DatabaseFile)
+	case "sqlite":
+		DB = sqlite.Open(conf.DatabaseFile)
 	case "memory":
-		DB = memory.Open("")
+		DB = memory.Open(conf.RetentionMaxRecords)
 	case "none":
 		DB = none.Open("")
 	default:
 		log.Fatalf("Unsupported database type: %s", conf.DatabaseType)
 	}
+
+	if conf.DatabaseAutoMigrate {
+		if err := Migrate(); err != nil {
+			log.Fatalf("Error migrating database: %s", err)
+		}
+	}
+}
+
+// Migrate brings the schema of the configured backend up to date. Backends without a schema are left alone.
+func Migrate() error {
+	m, ok := DB.(Migrator)
+	if !ok {
+		return nil
+	}
+	return m.Migrate()
 }
@@ -1,25 +1,27 @@
 package memory
 
 import (
-	"errors"
 	"sync"
 	"time"
 
 	"speedtest/database/schema"
 )
 
-const (
-	// just enough records to return for FetchLast100
-	maxRecords = 100
-)
-
 type Memory struct {
 	lock    sync.RWMutex
 	records []schema.TelemetryData
+	// maxRecords is the number of most recent records kept, zero keeps all of them
+	maxRecords int
+	usage      map[usageKey]int64
 }
 
-func Open(_ string) *Memory {
-	return &Memory{}
+type usageKey struct {
+	client string
+	period string
+}
+
+func Open(maxRecords int) *Memory {
+	return &Memory{maxRecords: maxRecords, usage: make(map[usageKey]int64)}
 }
 
 func (mem *Memory) Insert(data *schema.TelemetryData) error {
@@ -27,8 +29,8 @@ func (mem *Memory) Insert(data *schema.TelemetryData) error {
 	defer mem.lock.Unlock()
 	data.Timestamp = time.Now()
 	mem.records = append(mem.records, *data)
-	if len(mem.records) > maxRecords {
-		mem.records = mem.records[len(mem.records)-maxRecords:]
+	if mem.maxRecords > 0 && len(mem.records) > mem.maxRecords {
+		mem.records = mem.records[len(mem.records)-mem.maxRecords:]
 	}
 	return nil
 }
@@ -41,11 +43,86 @@ func (mem *Memory) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 			return &record, nil
 		}
 	}
-	return nil, errors.New("record not found")
+	return nil, schema.ErrNotFound
+}
+
+func (mem *Memory) Query(q schema.Query) (*schema.Page, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
+
+	var records []schema.TelemetryData
+	for i := range mem.records {
+		// records are kept in insertion order, oldest first
+		idx := len(mem.records) - 1 - i
+		if q.Order == schema.OldestFirst {
+			idx = i
+		}
+		record := mem.records[idx]
+		if q.AfterCursor(record.UUID) && q.Match(&record) {
+			records = append(records, record)
+			if len(records) > q.Limit {
+				break
+			}
+		}
+	}
+	return q.NewPage(records), nil
+}
+
+func (mem *Memory) Purge(maxAge time.Duration, maxRecords int) (int64, error) {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	before := len(mem.records)
+	if maxRecords > 0 && len(mem.records) > maxRecords {
+		mem.records = mem.records[len(mem.records)-maxRecords:]
+	}
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		// records are kept in insertion order, so expired ones are at the front
+		i := 0
+		for i < len(mem.records) && mem.records[i].Timestamp.Before(cutoff) {
+			i++
+		}
+		mem.records = mem.records[i:]
+	}
+	// copy so that the memory of deleted records can be released
+	mem.records = append([]schema.TelemetryData(nil), mem.records...)
+
+	return int64(before - len(mem.records)), nil
+}
+
+func (mem *Memory) AddUsage(client, period string, bytes int64) error {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	mem.usage[usageKey{client, period}] += bytes
+	return nil
 }
 
-func (mem *Memory) FetchLast100() ([]schema.TelemetryData, error) {
+func (mem *Memory) Usage(client, period string) (int64, error) {
 	mem.lock.RLock()
 	defer mem.lock.RUnlock()
-	return mem.records, nil
+	return mem.usage[usageKey{client, period}], nil
+}
+
+func (mem *Memory) PurgeUsage(before string) (int64, error) {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	var deleted int64
+	for k := range mem.usage {
+		if k.period < before {
+			delete(mem.usage, k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (mem *Memory) Close() error {
+	return nil
 }
@@ -0,0 +1,234 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Dialect holds the statements that differ between SQL databases.
+type Dialect struct {
+	// CreateTable creates the migrations tracking table if it doesn't exist yet
+	CreateTable string
+	// SelectVersions returns all applied migration versions
+	SelectVersions string
+	// InsertVersion records an applied migration, taking the version and the name as parameters
+	InsertVersion string
+	// Lock and Unlock serialize migrations between server instances sharing a database,
+	// they are skipped when empty
+	Lock   string
+	Unlock string
+	// Begin starts a transaction that holds the version check and all migrations, for databases
+	// that serialize writers by transaction instead of a lock. Migrations then run in their own
+	// transactions when empty
+	Begin string
+}
+
+// Migration is a single versioned schema change.
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// Load reads migrations from fsys. File names must have the form NNNN_name.sql, where NNNN
+// is the version. Statements in a file are separated by a semicolon at the end of a line.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name: %s", file)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", file, err)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, other, name)
+		}
+		seen[version] = name
+
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version:    version,
+			Name:       name,
+			Statements: splitStatements(string(b)),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func splitStatements(script string) []string {
+	var (
+		statements []string
+		current    strings.Builder
+	)
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// Run applies all migrations that haven't been recorded in the tracking table yet, in order.
+func Run(db *sql.DB, dialect Dialect, migrations []Migration) error {
+	ctx := context.Background()
+
+	// locks are held per connection, so all statements run on the same one
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if dialect.Begin != "" {
+		return runInTransaction(ctx, conn, dialect, migrations)
+	}
+
+	if dialect.Lock != "" {
+		if _, err := conn.ExecContext(ctx, dialect.Lock); err != nil {
+			return fmt.Errorf("cannot acquire migration lock: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(ctx, dialect.Unlock); err != nil {
+				log.Errorf("Cannot release migration lock: %s", err)
+			}
+		}()
+	}
+
+	applied, err := appliedVersions(ctx, conn, dialect)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := apply(ctx, tx, dialect, m); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// runInTransaction 在 dialect.Begin 开始的同一个事务中检查版本并应用所有迁移，
+// 同时启动的其他实例要等事务结束后才能读取版本
+func runInTransaction(ctx context.Context, conn *sql.Conn, dialect Dialect, migrations []Migration) error {
+	if _, err := conn.ExecContext(ctx, dialect.Begin); err != nil {
+		return fmt.Errorf("cannot start migration transaction: %w", err)
+	}
+
+	err := func() error {
+		applied, err := appliedVersions(ctx, conn, dialect)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if applied[m.Version] {
+				continue
+			}
+			if err := apply(ctx, conn, dialect, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		if _, rerr := conn.ExecContext(ctx, "ROLLBACK;"); rerr != nil {
+			log.Errorf("Cannot roll back migration transaction: %s", rerr)
+		}
+		return err
+	}
+
+	if _, err := conn.ExecContext(ctx, "COMMIT;"); err != nil {
+		return fmt.Errorf("cannot commit migrations: %w", err)
+	}
+	return nil
+}
+
+// execQuerier is implemented by *sql.Conn and *sql.Tx
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// appliedVersions 创建迁移记录表，返回已经应用的迁移版本
+func appliedVersions(ctx context.Context, db execQuerier, dialect Dialect) (map[int]bool, error) {
+	if _, err := db.ExecContext(ctx, dialect.CreateTable); err != nil {
+		return nil, fmt.Errorf("cannot create migrations table: %w", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := db.QueryContext(ctx, dialect.SelectVersions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// apply 执行一个迁移的所有语句并记录其版本
+func apply(ctx context.Context, db execQuerier, dialect Dialect, m Migration) error {
+	log.Infof("Applying database migration %s", m.Name)
+	for _, stmt := range m.Statements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.Name, err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, dialect.InsertVersion, m.Version, m.Name); err != nil {
+		return fmt.Errorf("cannot record migration %s: %w", m.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+-- Same layout as telemetry_mysql.sql shipped with earlier versions, so that
+-- manually created tables are picked up as they are.
+CREATE TABLE IF NOT EXISTS `speedtest_users` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `ip` text NOT NULL,
+  `ispinfo` text,
+  `extra` text,
+  `ua` text NOT NULL,
+  `lang` text NOT NULL,
+  `dl` text,
+  `ul` text,
+  `ping` text,
+  `jitter` text,
+  `log` longtext,
+  `uuid` text,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,10 @@
+-- Measurements used to be stored as text. Values that are not numbers (e.g. "" or "Fail")
+-- become NULL, so that 0003 can convert the columns. MySQL commits DDL implicitly, so a
+-- migration can be applied without being recorded and must give the same result when it runs
+-- again: this UPDATE and the MODIFY in 0003 do, the later ADD COLUMN and CREATE INDEX
+-- migrations check information_schema first.
+UPDATE `speedtest_users` SET
+  `dl` = IF(TRIM(`dl`) REGEXP '^[0-9]+(\\.[0-9]*)?([eE][-+]?[0-9]+)?$', TRIM(`dl`), NULL),
+  `ul` = IF(TRIM(`ul`) REGEXP '^[0-9]+(\\.[0-9]*)?([eE][-+]?[0-9]+)?$', TRIM(`ul`), NULL),
+  `ping` = IF(TRIM(`ping`) REGEXP '^[0-9]+(\\.[0-9]*)?([eE][-+]?[0-9]+)?$', TRIM(`ping`), NULL),
+  `jitter` = IF(TRIM(`jitter`) REGEXP '^[0-9]+(\\.[0-9]*)?([eE][-+]?[0-9]+)?$', TRIM(`jitter`), NULL);
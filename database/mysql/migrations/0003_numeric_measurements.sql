@@ -0,0 +1,6 @@
+-- Store measurements as numbers, the values were cleaned up by 0002
+ALTER TABLE `speedtest_users`
+  MODIFY `dl` double,
+  MODIFY `ul` double,
+  MODIFY `ping` double,
+  MODIFY `jitter` double;
@@ -0,0 +1,10 @@
+-- One index per migration, a failed CREATE INDEX must not leave the other one unrecorded.
+-- The index is only created when it's missing, like the columns in 0006.
+SET @migration = IF(
+  (SELECT COUNT(*) FROM information_schema.STATISTICS
+    WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'speedtest_users' AND INDEX_NAME = 'speedtest_users_uuid_idx') = 0,
+  'CREATE INDEX `speedtest_users_uuid_idx` ON `speedtest_users` (`uuid`(26))',
+  'DO 0');
+PREPARE migration FROM @migration;
+EXECUTE migration;
+DEALLOCATE PREPARE migration;
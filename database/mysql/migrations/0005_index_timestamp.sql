@@ -0,0 +1,8 @@
+SET @migration = IF(
+  (SELECT COUNT(*) FROM information_schema.STATISTICS
+    WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'speedtest_users' AND INDEX_NAME = 'speedtest_users_timestamp_idx') = 0,
+  'CREATE INDEX `speedtest_users_timestamp_idx` ON `speedtest_users` (`timestamp`)',
+  'DO 0');
+PREPARE migration FROM @migration;
+EXECUTE migration;
+DEALLOCATE PREPARE migration;
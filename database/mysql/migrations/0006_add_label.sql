@@ -0,0 +1,11 @@
+-- Name of the client's network assigned by the IP classification rules.
+-- MySQL has no ADD COLUMN IF NOT EXISTS and commits DDL implicitly, so the column is only
+-- added when it's missing, in case recording the migration failed after the ALTER TABLE.
+SET @migration = IF(
+  (SELECT COUNT(*) FROM information_schema.COLUMNS
+    WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'speedtest_users' AND COLUMN_NAME = 'label') = 0,
+  'ALTER TABLE `speedtest_users` ADD COLUMN `label` text AFTER `ip`',
+  'DO 0');
+PREPARE migration FROM @migration;
+EXECUTE migration;
+DEALLOCATE PREPARE migration;
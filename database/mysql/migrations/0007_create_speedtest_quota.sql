@@ -0,0 +1,7 @@
+-- Bytes transferred per client and quota period (YYYY-MM-DD or YYYY-MM)
+CREATE TABLE IF NOT EXISTS `speedtest_quota` (
+  `client` varchar(64) NOT NULL,
+  `period` varchar(10) NOT NULL,
+  `bytes` bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (`client`, `period`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,26 @@
+-- Throughput measured by the server, and whether the reported speeds differ too much from it.
+-- Each column is only added when it's missing, like in 0006.
+SET @migration = IF(
+  (SELECT COUNT(*) FROM information_schema.COLUMNS
+    WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'speedtest_users' AND COLUMN_NAME = 'server_dl') = 0,
+  'ALTER TABLE `speedtest_users` ADD COLUMN `server_dl` double',
+  'DO 0');
+PREPARE migration FROM @migration;
+EXECUTE migration;
+DEALLOCATE PREPARE migration;
+SET @migration = IF(
+  (SELECT COUNT(*) FROM information_schema.COLUMNS
+    WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'speedtest_users' AND COLUMN_NAME = 'server_ul') = 0,
+  'ALTER TABLE `speedtest_users` ADD COLUMN `server_ul` double',
+  'DO 0');
+PREPARE migration FROM @migration;
+EXECUTE migration;
+DEALLOCATE PREPARE migration;
+SET @migration = IF(
+  (SELECT COUNT(*) FROM information_schema.COLUMNS
+    WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'speedtest_users' AND COLUMN_NAME = 'suspicious') = 0,
+  'ALTER TABLE `speedtest_users` ADD COLUMN `suspicious` tinyint(1) NOT NULL DEFAULT 0',
+  'DO 0');
+PREPARE migration FROM @migration;
+EXECUTE migration;
+DEALLOCATE PREPARE migration;
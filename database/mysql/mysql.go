@@ -2,18 +2,47 @@ package mysql
 
 import (
 	"database/sql"
+	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
+	"time"
 
+	"speedtest/database/migrate"
 	"speedtest/database/schema"
+	"speedtest/database/sqlquery"
 
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	connectionStringTemplate = `%s:%s@%s/%s?parseTime=true`
+	// the session time zone matches the driver's UTC location, so timestamps are read and
+	// compared as UTC regardless of the server's time zone
+	connectionStringTemplate = `%s:%s@%s/%s?parseTime=true&time_zone=%%27%%2B00%%3A00%%27`
+	// selectColumns lists the speedtest_users columns in the order scanRecord reads them
+	selectColumns = "`timestamp`, `ip`, `label`, `ispinfo`, `extra`, `ua`, `lang`, `dl`, `ul`, `ping`, `jitter`, `log`, `uuid`, `server_dl`, `server_ul`, `suspicious`"
 )
 
+var (
+	//go:embed migrations/*.sql
+	migrationsFS embed.FS
+)
+
+var dialect = migrate.Dialect{
+	CreateTable:    "CREATE TABLE IF NOT EXISTS `speedtest_migrations` (`version` int NOT NULL PRIMARY KEY, `name` varchar(255) NOT NULL, `applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP);",
+	SelectVersions: "SELECT `version` FROM `speedtest_migrations`;",
+	InsertVersion:  "INSERT INTO `speedtest_migrations` (`version`, `name`) VALUES (?, ?);",
+	Lock:           "SELECT GET_LOCK('speedtest_migrations', -1);",
+	Unlock:         "SELECT RELEASE_LOCK('speedtest_migrations');",
+}
+
+var queryDialect = sqlquery.Dialect{
+	Placeholder: func(int) string { return "?" },
+	Timestamp:   "`timestamp`",
+	Like:        "LIKE",
+}
+
 type MySQL struct {
 	db *sql.DB
 }
@@ -28,39 +57,135 @@ func Open(hostname, username, password, database string) *MySQL {
 }
 
 func (p *MySQL) Insert(data *schema.TelemetryData) error {
-	stmt := `INSERT INTO speedtest_users (ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
-	_, err := p.db.Exec(stmt, data.IPAddress, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID)
+	stmt := `INSERT INTO speedtest_users (ip, label, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, server_dl, server_ul, suspicious) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := p.db.Exec(stmt, data.IPAddress, data.Label, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID, data.ServerDownload, data.ServerUpload, data.Suspicious)
 	return err
 }
 
 func (p *MySQL) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 	var record schema.TelemetryData
-	row := p.db.QueryRow(`SELECT * FROM speedtest_users WHERE uuid = ?`, uuid)
+	row := p.db.QueryRow("SELECT "+selectColumns+" FROM `speedtest_users` WHERE `uuid` = ?", uuid)
 	if row != nil {
-		var id string
-		if err := row.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
+		if err := scanRecord(row, &record); errors.Is(err, sql.ErrNoRows) {
+			return nil, schema.ErrNotFound
+		} else if err != nil {
 			return nil, err
 		}
 	}
 	return &record, nil
 }
 
-func (p *MySQL) FetchLast100() ([]schema.TelemetryData, error) {
-	var records []schema.TelemetryData
-	rows, err := p.db.Query(`SELECT * FROM speedtest_users ORDER BY "timestamp" DESC LIMIT 100;`)
+func (p *MySQL) Query(q schema.Query) (*schema.Page, error) {
+	q, err := q.Normalize()
 	if err != nil {
 		return nil, err
 	}
-	if rows != nil {
-		var id string
-
-		for rows.Next() {
-			var record schema.TelemetryData
-			if err := rows.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
-				return nil, err
-			}
-			records = append(records, record)
+
+	clause, args, filterIP := sqlquery.Build(queryDialect, q)
+	rows, err := p.db.Query("SELECT "+selectColumns+" FROM `speedtest_users`"+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlquery.Collect(rows, q, filterIP, scanRecord)
+}
+
+func (p *MySQL) Purge(maxAge time.Duration, maxRecords int) (int64, error) {
+	var deleted int64
+
+	if maxAge > 0 {
+		// compare against the database clock, the timestamp column uses its time zone
+		res, err := p.db.Exec("DELETE FROM `speedtest_users` WHERE `timestamp` < NOW() - INTERVAL ? SECOND;", int64(maxAge.Seconds()))
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+
+	if maxRecords > 0 {
+		// ids increase with every insert, so everything up to the id of the
+		// first record beyond maxRecords is older than the records to keep
+		var id int64
+		err := p.db.QueryRow("SELECT `id` FROM `speedtest_users` ORDER BY `id` DESC LIMIT 1 OFFSET ?;", maxRecords).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return deleted, nil
 		}
+		if err != nil {
+			return deleted, err
+		}
+		res, err := p.db.Exec("DELETE FROM `speedtest_users` WHERE `id` <= ?;", id)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+
+	return deleted, nil
+}
+
+func (p *MySQL) AddUsage(client, period string, bytes int64) error {
+	_, err := p.db.Exec("INSERT INTO `speedtest_quota` (`client`, `period`, `bytes`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `bytes` = `bytes` + VALUES(`bytes`);", client, period, bytes)
+	return err
+}
+
+func (p *MySQL) Usage(client, period string) (int64, error) {
+	var bytes int64
+	err := p.db.QueryRow("SELECT `bytes` FROM `speedtest_quota` WHERE `client` = ? AND `period` = ?;", client, period).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return bytes, err
+}
+
+func (p *MySQL) PurgeUsage(before string) (int64, error) {
+	res, err := p.db.Exec("DELETE FROM `speedtest_quota` WHERE `period` < ?;", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (p *MySQL) Close() error {
+	return p.db.Close()
+}
+
+// scanRecord reads a speedtest_users row selected with selectColumns. Measurements are scanned
+// as strings so that both the numeric columns and the text columns of older tables can be read.
+func scanRecord(row interface{ Scan(...any) error }, record *schema.TelemetryData) error {
+	var (
+		label, ispInfo, extra, logs, uuid sql.NullString
+		download, upload, ping, jitter    sql.NullString
+		serverDownload, serverUpload      sql.NullFloat64
+	)
+	if err := row.Scan(&record.Timestamp, &record.IPAddress, &label, &ispInfo, &extra, &record.UserAgent, &record.Language, &download, &upload, &ping, &jitter, &logs, &uuid, &serverDownload, &serverUpload, &record.Suspicious); err != nil {
+		return err
+	}
+
+	record.Version = schema.Version
+	record.Label = label.String
+	record.ISPInfo = ispInfo.String
+	record.Extra = extra.String
+	record.Log = logs.String
+	record.UUID = uuid.String
+	record.Download = schema.LegacyMeasurement(download.String)
+	record.Upload = schema.LegacyMeasurement(upload.String)
+	record.Ping = schema.LegacyMeasurement(ping.String)
+	record.Jitter = schema.LegacyMeasurement(jitter.String)
+	record.ServerDownload = serverDownload.Float64
+	record.ServerUpload = serverUpload.Float64
+	return nil
+}
+
+// Migrate creates or upgrades the speedtest_users table using the embedded migrations.
+func (p *MySQL) Migrate() error {
+	sub, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		return err
+	}
+	migrations, err := migrate.Load(sub)
+	if err != nil {
+		return err
 	}
-	return records, nil
+	return migrate.Run(p.db, dialect, migrations)
 }
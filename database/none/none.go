@@ -1,6 +1,8 @@
 package none
 
 import (
+	"time"
+
 	"speedtest/database/schema"
 )
 
@@ -18,6 +20,26 @@ func (n *None) FetchByUUID(_ string) (*schema.TelemetryData, error) {
 	return &schema.TelemetryData{}, nil
 }
 
-func (n *None) FetchLast100() ([]schema.TelemetryData, error) {
-	return []schema.TelemetryData{}, nil
+func (n *None) Query(_ schema.Query) (*schema.Page, error) {
+	return &schema.Page{Records: []schema.TelemetryData{}}, nil
+}
+
+func (n *None) Purge(_ time.Duration, _ int) (int64, error) {
+	return 0, nil
+}
+
+func (n *None) AddUsage(_, _ string, _ int64) error {
+	return nil
+}
+
+func (n *None) Usage(_, _ string) (int64, error) {
+	return 0, nil
+}
+
+func (n *None) PurgeUsage(_ string) (int64, error) {
+	return 0, nil
+}
+
+func (n *None) Close() error {
+	return nil
 }
@@ -0,0 +1,17 @@
+-- Same layout as telemetry_postgresql.sql shipped with earlier versions, so that
+-- manually created tables are picked up as they are.
+CREATE TABLE IF NOT EXISTS speedtest_users (
+    id serial PRIMARY KEY,
+    "timestamp" timestamp without time zone DEFAULT now() NOT NULL,
+    ip text NOT NULL,
+    ispinfo text,
+    extra text,
+    ua text NOT NULL,
+    lang text NOT NULL,
+    dl text,
+    ul text,
+    ping text,
+    jitter text,
+    log text,
+    uuid text
+);
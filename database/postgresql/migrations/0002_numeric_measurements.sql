@@ -0,0 +1,7 @@
+-- Measurements used to be stored as text. Values that are not numbers (e.g. "" or "Fail")
+-- become NULL.
+ALTER TABLE speedtest_users
+    ALTER COLUMN dl TYPE double precision USING CASE WHEN trim(dl::text) ~* '^[0-9]+(\.[0-9]*)?(e[-+]?[0-9]+)?$' THEN trim(dl::text)::double precision END,
+    ALTER COLUMN ul TYPE double precision USING CASE WHEN trim(ul::text) ~* '^[0-9]+(\.[0-9]*)?(e[-+]?[0-9]+)?$' THEN trim(ul::text)::double precision END,
+    ALTER COLUMN ping TYPE double precision USING CASE WHEN trim(ping::text) ~* '^[0-9]+(\.[0-9]*)?(e[-+]?[0-9]+)?$' THEN trim(ping::text)::double precision END,
+    ALTER COLUMN jitter TYPE double precision USING CASE WHEN trim(jitter::text) ~* '^[0-9]+(\.[0-9]*)?(e[-+]?[0-9]+)?$' THEN trim(jitter::text)::double precision END;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS speedtest_users_uuid_idx ON speedtest_users (uuid);
+CREATE INDEX IF NOT EXISTS speedtest_users_timestamp_idx ON speedtest_users ("timestamp");
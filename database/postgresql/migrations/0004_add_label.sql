@@ -0,0 +1,2 @@
+-- Name of the client's network assigned by the IP classification rules
+ALTER TABLE speedtest_users ADD COLUMN IF NOT EXISTS label text;
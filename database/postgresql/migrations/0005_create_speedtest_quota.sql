@@ -0,0 +1,7 @@
+-- Bytes transferred per client and quota period (YYYY-MM-DD or YYYY-MM)
+CREATE TABLE IF NOT EXISTS speedtest_quota (
+    client text NOT NULL,
+    period text NOT NULL,
+    bytes bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (client, period)
+);
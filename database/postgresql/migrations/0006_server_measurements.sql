@@ -0,0 +1,5 @@
+-- Throughput measured by the server, and whether the reported speeds differ too much from it
+ALTER TABLE speedtest_users
+    ADD COLUMN IF NOT EXISTS server_dl double precision,
+    ADD COLUMN IF NOT EXISTS server_ul double precision,
+    ADD COLUMN IF NOT EXISTS suspicious boolean NOT NULL DEFAULT false;
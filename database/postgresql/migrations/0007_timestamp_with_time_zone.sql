@@ -0,0 +1,4 @@
+-- Query bounds are bound as instants, a timestamp without time zone would compare them with
+-- wall clock values in the server's time zone. Existing values were written by now() in the
+-- session time zone and are converted from it.
+ALTER TABLE speedtest_users ALTER COLUMN "timestamp" TYPE timestamp with time zone;
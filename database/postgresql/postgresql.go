@@ -2,9 +2,16 @@ package postgresql
 
 import (
 	"database/sql"
+	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
+	"strconv"
+	"time"
 
+	"speedtest/database/migrate"
 	"speedtest/database/schema"
+	"speedtest/database/sqlquery"
 
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
@@ -12,8 +19,29 @@ import (
 
 const (
 	connectionStringTemplate = `postgres://%s:%s@%s/%s?sslmode=disable`
+	// selectColumns lists the speedtest_users columns in the order scanRecord reads them
+	selectColumns = `"timestamp", ip, label, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, server_dl, server_ul, suspicious`
 )
 
+var (
+	//go:embed migrations/*.sql
+	migrationsFS embed.FS
+)
+
+var dialect = migrate.Dialect{
+	CreateTable:    `CREATE TABLE IF NOT EXISTS speedtest_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at timestamp without time zone DEFAULT now() NOT NULL);`,
+	SelectVersions: `SELECT version FROM speedtest_migrations;`,
+	InsertVersion:  `INSERT INTO speedtest_migrations (version, name) VALUES ($1, $2);`,
+	Lock:           `SELECT pg_advisory_lock(7413361);`,
+	Unlock:         `SELECT pg_advisory_unlock(7413361);`,
+}
+
+var queryDialect = sqlquery.Dialect{
+	Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	Timestamp:   `"timestamp"`,
+	Like:        "ILIKE",
+}
+
 type PostgreSQL struct {
 	db *sql.DB
 }
@@ -28,39 +56,135 @@ func Open(hostname, username, password, database string) *PostgreSQL {
 }
 
 func (p *PostgreSQL) Insert(data *schema.TelemetryData) error {
-	stmt := `INSERT INTO speedtest_users (ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id;`
-	_, err := p.db.Exec(stmt, data.IPAddress, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID)
+	stmt := `INSERT INTO speedtest_users (ip, label, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, server_dl, server_ul, suspicious) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id;`
+	_, err := p.db.Exec(stmt, data.IPAddress, data.Label, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID, data.ServerDownload, data.ServerUpload, data.Suspicious)
 	return err
 }
 
 func (p *PostgreSQL) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 	var record schema.TelemetryData
-	row := p.db.QueryRow(`SELECT * FROM speedtest_users WHERE uuid = $1`, uuid)
+	row := p.db.QueryRow(`SELECT `+selectColumns+` FROM speedtest_users WHERE uuid = $1`, uuid)
 	if row != nil {
-		var id string
-		if err := row.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
+		if err := scanRecord(row, &record); errors.Is(err, sql.ErrNoRows) {
+			return nil, schema.ErrNotFound
+		} else if err != nil {
 			return nil, err
 		}
 	}
 	return &record, nil
 }
 
-func (p *PostgreSQL) FetchLast100() ([]schema.TelemetryData, error) {
-	var records []schema.TelemetryData
-	rows, err := p.db.Query(`SELECT * FROM speedtest_users ORDER BY "timestamp" DESC LIMIT 100;`)
+func (p *PostgreSQL) Query(q schema.Query) (*schema.Page, error) {
+	q, err := q.Normalize()
 	if err != nil {
 		return nil, err
 	}
-	if rows != nil {
-		var id string
-
-		for rows.Next() {
-			var record schema.TelemetryData
-			if err := rows.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
-				return nil, err
-			}
-			records = append(records, record)
+
+	clause, args, filterIP := sqlquery.Build(queryDialect, q)
+	rows, err := p.db.Query(`SELECT `+selectColumns+` FROM speedtest_users`+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlquery.Collect(rows, q, filterIP, scanRecord)
+}
+
+func (p *PostgreSQL) Purge(maxAge time.Duration, maxRecords int) (int64, error) {
+	var deleted int64
+
+	if maxAge > 0 {
+		// compare against the database clock, the timestamp column uses its time zone
+		res, err := p.db.Exec(`DELETE FROM speedtest_users WHERE "timestamp" < now() - $1 * interval '1 second';`, int64(maxAge.Seconds()))
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+
+	if maxRecords > 0 {
+		// ids increase with every insert, so everything up to the id of the
+		// first record beyond maxRecords is older than the records to keep
+		var id int64
+		err := p.db.QueryRow(`SELECT id FROM speedtest_users ORDER BY id DESC LIMIT 1 OFFSET $1;`, maxRecords).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return deleted, nil
 		}
+		if err != nil {
+			return deleted, err
+		}
+		res, err := p.db.Exec(`DELETE FROM speedtest_users WHERE id <= $1;`, id)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+
+	return deleted, nil
+}
+
+func (p *PostgreSQL) AddUsage(client, period string, bytes int64) error {
+	_, err := p.db.Exec(`INSERT INTO speedtest_quota (client, period, bytes) VALUES ($1, $2, $3) ON CONFLICT (client, period) DO UPDATE SET bytes = speedtest_quota.bytes + EXCLUDED.bytes;`, client, period, bytes)
+	return err
+}
+
+func (p *PostgreSQL) Usage(client, period string) (int64, error) {
+	var bytes int64
+	err := p.db.QueryRow(`SELECT bytes FROM speedtest_quota WHERE client = $1 AND period = $2;`, client, period).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return bytes, err
+}
+
+func (p *PostgreSQL) PurgeUsage(before string) (int64, error) {
+	res, err := p.db.Exec(`DELETE FROM speedtest_quota WHERE period < $1;`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (p *PostgreSQL) Close() error {
+	return p.db.Close()
+}
+
+// scanRecord reads a speedtest_users row selected with selectColumns. Measurements are scanned
+// as strings so that both the numeric columns and the text columns of older tables can be read.
+func scanRecord(row interface{ Scan(...any) error }, record *schema.TelemetryData) error {
+	var (
+		label, ispInfo, extra, logs, uuid sql.NullString
+		download, upload, ping, jitter    sql.NullString
+		serverDownload, serverUpload      sql.NullFloat64
+	)
+	if err := row.Scan(&record.Timestamp, &record.IPAddress, &label, &ispInfo, &extra, &record.UserAgent, &record.Language, &download, &upload, &ping, &jitter, &logs, &uuid, &serverDownload, &serverUpload, &record.Suspicious); err != nil {
+		return err
+	}
+
+	record.Version = schema.Version
+	record.Label = label.String
+	record.ISPInfo = ispInfo.String
+	record.Extra = extra.String
+	record.Log = logs.String
+	record.UUID = uuid.String
+	record.Download = schema.LegacyMeasurement(download.String)
+	record.Upload = schema.LegacyMeasurement(upload.String)
+	record.Ping = schema.LegacyMeasurement(ping.String)
+	record.Jitter = schema.LegacyMeasurement(jitter.String)
+	record.ServerDownload = serverDownload.Float64
+	record.ServerUpload = serverUpload.Float64
+	return nil
+}
+
+// Migrate creates or upgrades the speedtest_users table using the embedded migrations.
+func (p *PostgreSQL) Migrate() error {
+	sub, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		return err
+	}
+	migrations, err := migrate.Load(sub)
+	if err != nil {
+		return err
 	}
-	return records, nil
+	return migrate.Run(p.db, dialect, migrations)
 }
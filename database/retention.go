@@ -0,0 +1,83 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+)
+
+var (
+	purgeRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_retention_purge_runs_total",
+		Help: "Number of retention purge runs, by backend and result.",
+	}, []string{"backend", "result"})
+	purgedRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_retention_purged_records_total",
+		Help: "Number of test results deleted by the retention policy, by backend.",
+	}, []string{"backend"})
+	lastPurge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_retention_last_purge_timestamp_seconds",
+		Help: "Unix time of the last successful retention purge, by backend.",
+	}, []string{"backend"})
+)
+
+func init() {
+	prometheus.MustRegister(purgeRuns, purgedRecords, lastPurge)
+}
+
+// StartRetention periodically deletes test results older than retention_max_age and
+// beyond the newest retention_max_records. The returned channel is closed once the
+// job has stopped after ctx is cancelled.
+func StartRetention(ctx context.Context, conf *config.Config) <-chan struct{} {
+	done := make(chan struct{})
+
+	if conf.RetentionMaxAge <= 0 && conf.RetentionMaxRecords <= 0 {
+		close(done)
+		return done
+	}
+
+	interval := conf.RetentionInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	log.Infof("Enforcing data retention (max age: %s, max records: %d) every %s", conf.RetentionMaxAge, conf.RetentionMaxRecords, interval)
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			purge(conf)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return done
+}
+
+func purge(conf *config.Config) {
+	start := time.Now()
+	deleted, err := DB.Purge(conf.RetentionMaxAge, conf.RetentionMaxRecords)
+	if err != nil {
+		purgeRuns.WithLabelValues(conf.DatabaseType, "error").Inc()
+		log.Errorf("Error purging expired test results: %s", err)
+		return
+	}
+
+	purgeRuns.WithLabelValues(conf.DatabaseType, "success").Inc()
+	purgedRecords.WithLabelValues(conf.DatabaseType).Add(float64(deleted))
+	lastPurge.WithLabelValues(conf.DatabaseType).SetToCurrentTime()
+	log.Infof("Retention purge deleted %d test results in %s", deleted, time.Since(start).Round(time.Millisecond))
+}
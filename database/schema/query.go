@@ -0,0 +1,171 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultQueryLimit is the page size used when Query.Limit is not set
+	DefaultQueryLimit = 100
+	// MaxQueryLimit is the largest page size a single query may return
+	MaxQueryLimit = 1000
+	// MaxScanRows bounds the rows a SQL backend reads for a page when a CIDR filter has to be checked
+	// on every row. The page then ends early, and its cursor continues after the last row read
+	MaxScanRows = 10000
+)
+
+type Order int
+
+const (
+	NewestFirst Order = iota
+	OldestFirst
+)
+
+// Query selects test results. Zero values mean "no restriction", except for Limit,
+// which defaults to DefaultQueryLimit.
+type Query struct {
+	// From and To restrict the timestamp to [From, To)
+	From time.Time
+	To   time.Time
+	// IP is a single address or a CIDR prefix
+	IP string
+	// ISP is matched case-insensitively as a substring of ISPInfo
+	ISP string
+
+	MinDownload float64
+	MaxDownload float64
+	MinUpload   float64
+	MaxUpload   float64
+	MinPing     float64
+	MaxPing     float64
+
+	Order Order
+	Limit int
+	// Cursor is Page.NextCursor of the previous page
+	Cursor string
+
+	prefix netip.Prefix
+}
+
+// Page is one page of query results. NextCursor is empty on the last page.
+type Page struct {
+	Records    []TelemetryData
+	NextCursor string
+}
+
+var (
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+// Normalize validates q and applies defaults. Backends call it before running a query.
+func (q Query) Normalize() (Query, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultQueryLimit
+	}
+	if q.Limit > MaxQueryLimit {
+		q.Limit = MaxQueryLimit
+	}
+
+	if q.Order != NewestFirst && q.Order != OldestFirst {
+		return q, fmt.Errorf("%w: unknown order", ErrInvalidQuery)
+	}
+
+	q.prefix = netip.Prefix{}
+	if q.IP != "" {
+		prefix, err := ParseIPPrefix(q.IP)
+		if err != nil {
+			return q, fmt.Errorf("%w: %w", ErrInvalidQuery, err)
+		}
+		q.prefix = prefix
+	}
+
+	return q, nil
+}
+
+// ParseIPPrefix parses a CIDR prefix or a single address, which is treated as a full-length prefix.
+func ParseIPPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return prefix, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// SingleIP returns the address when the IP filter matches exactly one address.
+func (q *Query) SingleIP() (string, bool) {
+	if !q.prefix.IsValid() || !q.prefix.IsSingleIP() {
+		return "", false
+	}
+	return q.prefix.Addr().String(), true
+}
+
+// MatchIP reports whether ip is covered by the IP filter.
+func (q *Query) MatchIP(ip string) bool {
+	if !q.prefix.IsValid() {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return q.prefix.Contains(addr.Unmap())
+}
+
+// AfterCursor reports whether a record with the given UUID comes after the cursor in the query order.
+// Test IDs are ULIDs, so they sort in the order the tests were recorded.
+func (q *Query) AfterCursor(uuid string) bool {
+	if q.Cursor == "" {
+		return true
+	}
+	if q.Order == OldestFirst {
+		return uuid > q.Cursor
+	}
+	return uuid < q.Cursor
+}
+
+// Match reports whether r satisfies every condition of q, except for the cursor.
+func (q *Query) Match(r *TelemetryData) bool {
+	switch {
+	case !q.From.IsZero() && r.Timestamp.Before(q.From):
+		return false
+	case !q.To.IsZero() && !r.Timestamp.Before(q.To):
+		return false
+	case q.ISP != "" && !strings.Contains(strings.ToLower(r.ISPInfo), strings.ToLower(q.ISP)):
+		return false
+	case q.MinDownload > 0 && r.Download < q.MinDownload,
+		q.MaxDownload > 0 && r.Download > q.MaxDownload,
+		q.MinUpload > 0 && r.Upload < q.MinUpload,
+		q.MaxUpload > 0 && r.Upload > q.MaxUpload,
+		q.MinPing > 0 && r.Ping < q.MinPing,
+		q.MaxPing > 0 && r.Ping > q.MaxPing:
+		return false
+	}
+	return q.MatchIP(r.IPAddress)
+}
+
+// NewPage builds a page from up to Limit+1 matching records in query order. The extra
+// record only signals that another page exists.
+func (q *Query) NewPage(records []TelemetryData) *Page {
+	page := &Page{Records: records}
+	if len(records) > q.Limit {
+		page.Records = records[:q.Limit]
+		page.NextCursor = page.Records[q.Limit-1].UUID
+	}
+	if page.Records == nil {
+		page.Records = []TelemetryData{}
+	}
+	return page
+}
@@ -1,20 +1,129 @@
 package schema
 
 import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// Version is the current layout of TelemetryData. Version 1 (stored without a version)
+	// kept Download, Upload, Ping and Jitter as strings, version 2 had no Label and version 3
+	// had no server-side measurements.
+	Version = 4
+)
+
+// TelemetryData is a single test result. Download and Upload are in Mbit/s, Ping and Jitter in milliseconds.
+// Label is the name the IP classification rules give to the client's network. ServerDownload and
+// ServerUpload are the speeds measured by the server during the test, Suspicious is set when the
+// speeds reported by the client differ too much from them.
 type TelemetryData struct {
+	Version   int
 	Timestamp time.Time
 	IPAddress string
+	Label     string
 	ISPInfo   string
 	Extra     string
 	UserAgent string
 	Language  string
-	Download  string
-	Upload    string
-	Ping      string
-	Jitter    string
+	Download  float64
+	Upload    float64
+	Ping      float64
+	Jitter    float64
 	Log       string
 	UUID      string
+
+	ServerDownload float64
+	ServerUpload   float64
+	Suspicious     bool
+}
+
+var (
+	ErrInvalidMeasurement = errors.New("measurement must be a non-negative finite number")
+	// ErrNotFound is returned by FetchByUUID when no record has the requested ID
+	ErrNotFound = errors.New("record not found")
+)
+
+// ParseMeasurement parses a measurement as submitted by the frontend. An empty value or "Fail"
+// means the test did not run or failed, and is stored as 0.
+func ParseMeasurement(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "Fail" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+		return 0, ErrInvalidMeasurement
+	}
+	return v, nil
+}
+
+// LegacyMeasurement converts a measurement stored as a string by version 1 of the schema.
+// Values that cannot be parsed are converted to 0.
+func LegacyMeasurement(s string) float64 {
+	v, err := ParseMeasurement(s)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// UnmarshalJSON decodes both the current layout and version 1 records, where the
+// measurements were JSON strings.
+func (t *TelemetryData) UnmarshalJSON(b []byte) error {
+	type telemetryData TelemetryData
+	var raw struct {
+		telemetryData
+		Download json.RawMessage
+		Upload   json.RawMessage
+		Ping     json.RawMessage
+		Jitter   json.RawMessage
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*t = TelemetryData(raw.telemetryData)
+	for _, m := range []struct {
+		dst *float64
+		src json.RawMessage
+	}{
+		{&t.Download, raw.Download},
+		{&t.Upload, raw.Upload},
+		{&t.Ping, raw.Ping},
+		{&t.Jitter, raw.Jitter},
+	} {
+		v, err := decodeMeasurement(m.src)
+		if err != nil {
+			return err
+		}
+		*m.dst = v
+	}
+
+	if t.Version == 0 {
+		t.Version = Version
+	}
+	return nil
+}
+
+func decodeMeasurement(b json.RawMessage) (float64, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return 0, nil
+	}
+
+	if b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return 0, err
+		}
+		return LegacyMeasurement(s), nil
+	}
+
+	var v float64
+	err := json.Unmarshal(b, &v)
+	return v, err
 }
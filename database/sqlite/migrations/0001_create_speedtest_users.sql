@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS speedtest_users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    "timestamp" datetime NOT NULL,
+    ip text NOT NULL,
+    ispinfo text,
+    extra text,
+    ua text NOT NULL,
+    lang text NOT NULL,
+    dl real,
+    ul real,
+    ping real,
+    jitter real,
+    log text,
+    uuid text
+);
+CREATE INDEX IF NOT EXISTS speedtest_users_uuid_idx ON speedtest_users (uuid);
+CREATE INDEX IF NOT EXISTS speedtest_users_timestamp_idx ON speedtest_users ("timestamp");
@@ -0,0 +1,4 @@
+-- Throughput measured by the server, and whether the reported speeds differ too much from it
+ALTER TABLE speedtest_users ADD COLUMN server_dl real;
+ALTER TABLE speedtest_users ADD COLUMN server_ul real;
+ALTER TABLE speedtest_users ADD COLUMN suspicious integer NOT NULL DEFAULT 0;
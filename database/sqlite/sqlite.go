@@ -0,0 +1,204 @@
+package sqlite
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+	"net/url"
+	"time"
+
+	"speedtest/database/migrate"
+	"speedtest/database/schema"
+	"speedtest/database/sqlquery"
+
+	log "github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// selectColumns lists the speedtest_users columns in the order scanRecord reads them
+	selectColumns = `"timestamp", ip, label, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, server_dl, server_ul, suspicious`
+)
+
+var (
+	//go:embed migrations/*.sql
+	migrationsFS embed.FS
+)
+
+// BEGIN IMMEDIATE takes the write lock before the versions are read, so that server instances
+// starting together don't apply the same migration twice
+var dialect = migrate.Dialect{
+	CreateTable:    `CREATE TABLE IF NOT EXISTS speedtest_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at datetime DEFAULT CURRENT_TIMESTAMP NOT NULL);`,
+	SelectVersions: `SELECT version FROM speedtest_migrations;`,
+	InsertVersion:  `INSERT INTO speedtest_migrations (version, name) VALUES (?, ?);`,
+	Begin:          `BEGIN IMMEDIATE;`,
+}
+
+var queryDialect = sqlquery.Dialect{
+	Placeholder: func(int) string { return "?" },
+	Timestamp:   `"timestamp"`,
+	Like:        "LIKE",
+}
+
+type SQLite struct {
+	db *sql.DB
+}
+
+func Open(databaseFile string) *SQLite {
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "foreign_keys(1)")
+	if databaseFile != ":memory:" {
+		params.Add("_pragma", "journal_mode(WAL)")
+	}
+	params.Set("_time_format", "sqlite")
+
+	conn, err := sql.Open("sqlite", "file:"+databaseFile+"?"+params.Encode())
+	if err != nil {
+		log.Fatalf("Cannot open SQLite database: %s", err)
+	}
+	if databaseFile == ":memory:" {
+		// every connection to :memory: opens a separate database
+		conn.SetMaxOpenConns(1)
+	}
+	return &SQLite{db: conn}
+}
+
+func (p *SQLite) Insert(data *schema.TelemetryData) error {
+	data.Timestamp = time.Now().UTC()
+	stmt := `INSERT INTO speedtest_users ("timestamp", ip, label, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, server_dl, server_ul, suspicious) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := p.db.Exec(stmt, data.Timestamp, data.IPAddress, data.Label, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID, data.ServerDownload, data.ServerUpload, data.Suspicious)
+	return err
+}
+
+func (p *SQLite) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
+	var record schema.TelemetryData
+	row := p.db.QueryRow(`SELECT `+selectColumns+` FROM speedtest_users WHERE uuid = ?`, uuid)
+	if err := scanRecord(row, &record); errors.Is(err, sql.ErrNoRows) {
+		return nil, schema.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (p *SQLite) Query(q schema.Query) (*schema.Page, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	// timestamps are stored as UTC strings, so bounds must be UTC as well to compare correctly
+	if !q.From.IsZero() {
+		q.From = q.From.UTC()
+	}
+	if !q.To.IsZero() {
+		q.To = q.To.UTC()
+	}
+
+	clause, args, filterIP := sqlquery.Build(queryDialect, q)
+	rows, err := p.db.Query(`SELECT `+selectColumns+` FROM speedtest_users`+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlquery.Collect(rows, q, filterIP, scanRecord)
+}
+
+func (p *SQLite) Purge(maxAge time.Duration, maxRecords int) (int64, error) {
+	var deleted int64
+
+	if maxAge > 0 {
+		// timestamps are stored as UTC strings, compare against a UTC cutoff
+		res, err := p.db.Exec(`DELETE FROM speedtest_users WHERE "timestamp" < ?;`, time.Now().UTC().Add(-maxAge))
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+
+	if maxRecords > 0 {
+		// ids increase with every insert, so everything up to the id of the
+		// first record beyond maxRecords is older than the records to keep
+		var id int64
+		err := p.db.QueryRow(`SELECT id FROM speedtest_users ORDER BY id DESC LIMIT 1 OFFSET ?;`, maxRecords).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return deleted, nil
+		}
+		if err != nil {
+			return deleted, err
+		}
+		res, err := p.db.Exec(`DELETE FROM speedtest_users WHERE id <= ?;`, id)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+
+	return deleted, nil
+}
+
+func (p *SQLite) AddUsage(client, period string, bytes int64) error {
+	_, err := p.db.Exec(`INSERT INTO speedtest_quota (client, period, bytes) VALUES (?, ?, ?) ON CONFLICT (client, period) DO UPDATE SET bytes = bytes + excluded.bytes;`, client, period, bytes)
+	return err
+}
+
+func (p *SQLite) Usage(client, period string) (int64, error) {
+	var bytes int64
+	err := p.db.QueryRow(`SELECT bytes FROM speedtest_quota WHERE client = ? AND period = ?;`, client, period).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return bytes, err
+}
+
+func (p *SQLite) PurgeUsage(before string) (int64, error) {
+	res, err := p.db.Exec(`DELETE FROM speedtest_quota WHERE period < ?;`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (p *SQLite) Close() error {
+	return p.db.Close()
+}
+
+// Migrate creates or upgrades the speedtest_users table using the embedded migrations.
+func (p *SQLite) Migrate() error {
+	sub, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		return err
+	}
+	migrations, err := migrate.Load(sub)
+	if err != nil {
+		return err
+	}
+	return migrate.Run(p.db, dialect, migrations)
+}
+
+// scanRecord reads a speedtest_users row selected with selectColumns.
+func scanRecord(row interface{ Scan(...any) error }, record *schema.TelemetryData) error {
+	var (
+		label, ispInfo, extra, logs    sql.NullString
+		download, upload, ping, jitter sql.NullFloat64
+		serverDownload, serverUpload   sql.NullFloat64
+	)
+	if err := row.Scan(&record.Timestamp, &record.IPAddress, &label, &ispInfo, &extra, &record.UserAgent, &record.Language, &download, &upload, &ping, &jitter, &logs, &record.UUID, &serverDownload, &serverUpload, &record.Suspicious); err != nil {
+		return err
+	}
+
+	record.Version = schema.Version
+	record.Label = label.String
+	record.ISPInfo = ispInfo.String
+	record.Extra = extra.String
+	record.Log = logs.String
+	record.Download = download.Float64
+	record.Upload = upload.Float64
+	record.Ping = ping.Float64
+	record.Jitter = jitter.Float64
+	record.ServerDownload = serverDownload.Float64
+	record.ServerUpload = serverUpload.Float64
+	return nil
+}
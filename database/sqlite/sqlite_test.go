@@ -0,0 +1,194 @@
+package sqlite
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"speedtest/database/schema"
+)
+
+// newTestDB 打开迁移完成的内存数据库
+func newTestDB(t *testing.T) *SQLite {
+	t.Helper()
+	s := Open(":memory:")
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// insert 按顺序插入使用给定地址的记录，测试 ID 按插入顺序递增
+func insert(t *testing.T, s *SQLite, ips ...string) []string {
+	t.Helper()
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM speedtest_users;`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	uuids := make([]string, len(ips))
+	for i, ip := range ips {
+		uuids[i] = fmt.Sprintf("%026d", count+i)
+		if err := s.Insert(&schema.TelemetryData{IPAddress: ip, ISPInfo: "{}", UUID: uuids[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return uuids
+}
+
+func uuidsOf(page *schema.Page) []string {
+	uuids := make([]string, len(page.Records))
+	for i, r := range page.Records {
+		uuids[i] = r.UUID
+	}
+	return uuids
+}
+
+func TestQueryIP(t *testing.T) {
+	s := newTestDB(t)
+	ids := insert(t, s, "192.0.2.1", "198.51.100.7", "192.0.2.200", "2001:db8::1", "::ffff:192.0.2.5", "2001:db9::1")
+
+	tests := []struct {
+		ip   string
+		want []string
+	}{
+		{"192.0.2.0/24", []string{ids[4], ids[2], ids[0]}},
+		{"192.0.2.128/25", []string{ids[2]}},
+		{"198.51.100.7", []string{ids[1]}},
+		{"198.51.100.7/32", []string{ids[1]}},
+		{"2001:db8::/32", []string{ids[3]}},
+		{"203.0.113.0/24", []string{}},
+	}
+	for _, tt := range tests {
+		page, err := s.Query(schema.Query{IP: tt.ip})
+		if err != nil {
+			t.Errorf("Query(%s): %s", tt.ip, err)
+			continue
+		}
+		if got := fmt.Sprint(uuidsOf(page)); got != fmt.Sprint(tt.want) || page.NextCursor != "" {
+			t.Errorf("Query(%s) = %s, cursor %q, want %v", tt.ip, got, page.NextCursor, tt.want)
+		}
+	}
+}
+
+func TestQueryTimeRange(t *testing.T) {
+	s := newTestDB(t)
+	ids := insert(t, s, "192.0.2.1")
+	ts := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	if _, err := s.db.Exec(`UPDATE speedtest_users SET "timestamp" = ? WHERE uuid = ?;`, ts, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same instants in another time zone select the same records
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	tests := []struct {
+		from, to time.Time
+		want     int
+	}{
+		{ts, time.Time{}, 1},
+		{ts.In(zone), time.Time{}, 1},
+		{ts.In(zone).Add(time.Second), time.Time{}, 0},
+		{time.Time{}, ts.In(zone), 0},
+		{time.Time{}, ts.In(zone).Add(time.Second), 1},
+		{ts.Add(-time.Hour).In(zone), ts.Add(time.Hour).In(zone), 1},
+	}
+	for _, tt := range tests {
+		page, err := s.Query(schema.Query{From: tt.from, To: tt.to})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Records) != tt.want {
+			t.Errorf("Query(from %s, to %s) returned %d records, want %d", tt.from, tt.to, len(page.Records), tt.want)
+		}
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	s := newTestDB(t)
+	var ips []string
+	for i := 0; i < 25; i++ {
+		ips = append(ips, fmt.Sprintf("192.0.2.%d", i), fmt.Sprintf("198.51.100.%d", i))
+	}
+	insert(t, s, ips...)
+
+	for _, q := range []schema.Query{
+		{Limit: 10},
+		{Limit: 10, Order: schema.OldestFirst},
+		{Limit: 10, IP: "192.0.2.0/24"},
+		{Limit: 10, IP: "192.0.2.0/24", Order: schema.OldestFirst},
+	} {
+		want := len(ips)
+		if q.IP != "" {
+			want = len(ips) / 2
+		}
+		seen := map[string]bool{}
+		var previous string
+		for pages := 0; ; pages++ {
+			if pages > want {
+				t.Fatalf("%+v: cursor doesn't advance", q)
+			}
+			page, err := s.Query(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range page.Records {
+				if seen[r.UUID] {
+					t.Errorf("%+v: %s returned twice", q, r.UUID)
+				}
+				if previous != "" && (r.UUID > previous) != (q.Order == schema.OldestFirst) {
+					t.Errorf("%+v: %s out of order after %s", q, r.UUID, previous)
+				}
+				if !q.MatchIP(r.IPAddress) && q.IP != "" {
+					t.Errorf("%+v: %s doesn't match", q, r.IPAddress)
+				}
+				seen[r.UUID] = true
+				previous = r.UUID
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		if len(seen) != want {
+			t.Errorf("%+v: %d records over all pages, want %d", q, len(seen), want)
+		}
+	}
+}
+
+func TestQueryScanLimit(t *testing.T) {
+	s := newTestDB(t)
+	matching := insert(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	ips := make([]string, schema.MaxScanRows)
+	for i := range ips {
+		ips[i] = "198.51.100.1"
+	}
+	others := insert(t, s, ips...)
+
+	// the newest MaxScanRows records don't match, the first page ends after reading them
+	q := schema.Query{IP: "192.0.2.0/24", Limit: 2}
+	page, err := s.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 0 || page.NextCursor != others[0] {
+		t.Fatalf("first page: %d records, cursor %q, want none and cursor %q", len(page.Records), page.NextCursor, others[0])
+	}
+
+	q.Cursor = page.NextCursor
+	page, err = s.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(uuidsOf(page)), fmt.Sprint([]string{matching[2], matching[1]}); got != want || page.NextCursor != matching[1] {
+		t.Fatalf("second page: %s, cursor %q, want %s and cursor %q", got, page.NextCursor, want, matching[1])
+	}
+
+	q.Cursor = page.NextCursor
+	page, err = s.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(uuidsOf(page)), fmt.Sprint([]string{matching[0]}); got != want || page.NextCursor != "" {
+		t.Fatalf("last page: %s, cursor %q, want %s and no cursor", got, page.NextCursor, want)
+	}
+}
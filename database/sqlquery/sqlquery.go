@@ -0,0 +1,127 @@
+package sqlquery
+
+import (
+	"database/sql"
+	"strings"
+
+	"speedtest/database/schema"
+)
+
+// Dialect holds the syntax that differs between SQL databases.
+type Dialect struct {
+	// Placeholder returns the bind parameter for the n-th argument, starting at 1
+	Placeholder func(n int) string
+	// Timestamp is the quoted timestamp column
+	Timestamp string
+	// Like is the case-insensitive LIKE operator
+	Like string
+}
+
+// Build returns the WHERE, ORDER BY and LIMIT clauses for a normalized query. CIDR filters
+// can't be expressed portably on the text ip column, so when filterIP is true the caller
+// has to check q.MatchIP on every row and the clause limits the rows to schema.MaxScanRows.
+func Build(d Dialect, q schema.Query) (clause string, args []any, filterIP bool) {
+	var conditions []string
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.Replace(cond, "?", d.Placeholder(len(args)), 1))
+	}
+
+	if !q.From.IsZero() {
+		add(d.Timestamp+" >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		add(d.Timestamp+" < ?", q.To)
+	}
+	if q.IP != "" {
+		if ip, ok := q.SingleIP(); ok {
+			add("ip = ?", ip)
+		} else {
+			filterIP = true
+		}
+	}
+	if q.ISP != "" {
+		add("ispinfo "+d.Like+" ? ESCAPE '!'", "%"+escapeLike(q.ISP)+"%")
+	}
+	for _, t := range []struct {
+		cond  string
+		value float64
+	}{
+		{"dl >= ?", q.MinDownload},
+		{"dl <= ?", q.MaxDownload},
+		{"ul >= ?", q.MinUpload},
+		{"ul <= ?", q.MaxUpload},
+		{"ping >= ?", q.MinPing},
+		{"ping <= ?", q.MaxPing},
+	} {
+		if t.value > 0 {
+			add(t.cond, t.value)
+		}
+	}
+
+	order := "DESC"
+	if q.Order == schema.OldestFirst {
+		order = "ASC"
+	}
+	if q.Cursor != "" {
+		if q.Order == schema.OldestFirst {
+			add("uuid > ?", q.Cursor)
+		} else {
+			add("uuid < ?", q.Cursor)
+		}
+	}
+
+	var b strings.Builder
+	if len(conditions) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(conditions, " AND "))
+	}
+	b.WriteString(" ORDER BY uuid ")
+	b.WriteString(order)
+	if filterIP {
+		args = append(args, schema.MaxScanRows)
+	} else {
+		args = append(args, q.Limit+1)
+	}
+	b.WriteString(" LIMIT ")
+	b.WriteString(d.Placeholder(len(args)))
+
+	return b.String(), args, filterIP
+}
+
+// Collect reads the rows of a query built with Build into a page.
+func Collect(rows *sql.Rows, q schema.Query, filterIP bool, scan func(interface{ Scan(...any) error }, *schema.TelemetryData) error) (*schema.Page, error) {
+	defer rows.Close()
+
+	var (
+		records []schema.TelemetryData
+		scanned int
+		last    string
+	)
+	for len(records) <= q.Limit && rows.Next() {
+		var record schema.TelemetryData
+		if err := scan(rows, &record); err != nil {
+			return nil, err
+		}
+		scanned++
+		last = record.UUID
+		if filterIP && !q.MatchIP(record.IPAddress) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := q.NewPage(records)
+	if filterIP && page.NextCursor == "" && scanned == schema.MaxScanRows {
+		// more rows may match, the next page continues where this one stopped reading
+		page.NextCursor = last
+	}
+	return page, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
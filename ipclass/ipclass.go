@@ -0,0 +1,106 @@
+package ipclass
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+)
+
+// Rule assigns a label to every address in Prefix
+type Rule struct {
+	Prefix netip.Prefix
+	Label  string
+}
+
+// builtinRules are the special-purpose ranges that are not looked up with the IP info providers
+var builtinRules = []Rule{
+	{netip.MustParsePrefix("::1/128"), "localhost IPv6 access"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local IPv6 access"},
+	{netip.MustParsePrefix("fc00::/7"), "unique local IPv6 access"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "localhost IPv4 access"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private IPv4 access"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private IPv4 access"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private IPv4 access"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local IPv4 access"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "CGNAT IPv4 access"},
+}
+
+var (
+	classifier = New(nil)
+)
+
+// Classifier labels addresses with the user-defined rules and the built-in special-purpose ranges
+type Classifier struct {
+	rules []Rule
+}
+
+// New 创建分类器，rules 优先于内置的特殊地址范围，多条规则匹配时使用前缀最长的规则
+func New(rules []Rule) *Classifier {
+	rules = append([]Rule(nil), rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Prefix.Bits() > rules[j].Prefix.Bits()
+	})
+	return &Classifier{rules: rules}
+}
+
+// ParseRules 解析配置中的 CIDR 到标签的映射
+func ParseRules(labels []config.IPLabel) ([]Rule, error) {
+	rules := make([]Rule, 0, len(labels))
+	for _, l := range labels {
+		prefix, err := netip.ParsePrefix(l.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", l.CIDR, err)
+		}
+		if l.Label == "" {
+			return nil, fmt.Errorf("missing label for %s", l.CIDR)
+		}
+		rules = append(rules, Rule{Prefix: prefix.Masked(), Label: l.Label})
+	}
+	return rules, nil
+}
+
+// Initialize 加载 ip_labels 中配置的分类规则
+func Initialize(conf *config.Config) {
+	rules, err := ParseRules(conf.IPLabels)
+	if err != nil {
+		log.Fatalf("Error parsing ip_labels: %s", err)
+	}
+	if len(rules) > 0 {
+		log.Infof("Loaded %d IP label rules", len(rules))
+	}
+	classifier = New(rules)
+}
+
+// Classify 使用全局分类器对 addr 分类，addr 无法解析时返回空标签
+func Classify(addr string) (label string, special bool) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "", false
+	}
+	return classifier.Classify(ip)
+}
+
+// Classify 返回 ip 的标签，以及 ip 是否属于不需要查询 ISP 信息的特殊地址范围。
+// 用户规则的标签优先于内置范围的描述
+func (c *Classifier) Classify(ip netip.Addr) (label string, special bool) {
+	ip = ip.Unmap().WithZone("")
+
+	for _, r := range builtinRules {
+		if r.Prefix.Contains(ip) {
+			label, special = r.Label, true
+			break
+		}
+	}
+
+	for _, r := range c.rules {
+		if r.Prefix.Contains(ip) {
+			return r.Label, special
+		}
+	}
+
+	return label, special
+}
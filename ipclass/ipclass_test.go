@@ -0,0 +1,75 @@
+package ipclass
+
+import (
+	"net/netip"
+	"testing"
+
+	"speedtest/config"
+)
+
+func TestClassify(t *testing.T) {
+	rules, err := ParseRules([]config.IPLabel{
+		{CIDR: "10.0.0.0/8", Label: "corporate"},
+		{CIDR: "10.20.30.0/24", Label: "lab"},
+		{CIDR: "10.20.0.0/16", Label: "HQ"},
+		{CIDR: "203.0.113.0/24", Label: "office"},
+		{CIDR: "203.0.113.0/24", Label: "duplicate"},
+		{CIDR: "2001:db8::/32", Label: "IPv6 office"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(rules)
+
+	tests := []struct {
+		addr        string
+		wantLabel   string
+		wantSpecial bool
+	}{
+		// the longest matching prefix wins, regardless of the order of the rules
+		{"10.20.30.4", "lab", true},
+		{"10.20.1.1", "HQ", true},
+		{"10.1.1.1", "corporate", true},
+		{"::ffff:10.20.30.4", "lab", true},
+		// rules with the same prefix keep their order
+		{"203.0.113.9", "office", false},
+		{"2001:db8::1", "IPv6 office", false},
+		// built-in ranges without a user rule
+		{"127.0.0.1", "localhost IPv4 access", true},
+		{"172.16.5.4", "private IPv4 access", true},
+		{"100.64.0.1", "CGNAT IPv4 access", true},
+		{"fe80::1%eth0", "link-local IPv6 access", true},
+		{"::1", "localhost IPv6 access", true},
+		{"8.8.8.8", "", false},
+		{"2001:4860::8888", "", false},
+	}
+	for _, tt := range tests {
+		label, special := c.Classify(netip.MustParseAddr(tt.addr))
+		if label != tt.wantLabel || special != tt.wantSpecial {
+			t.Errorf("Classify(%s) = %q, %v, want %q, %v", tt.addr, label, special, tt.wantLabel, tt.wantSpecial)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		labels  []config.IPLabel
+		want    string
+		wantErr bool
+	}{
+		{[]config.IPLabel{{CIDR: "10.20.30.4/24", Label: "lab"}}, "10.20.30.0/24", false},
+		{[]config.IPLabel{{CIDR: "10.20.30.4", Label: "lab"}}, "", true},
+		{[]config.IPLabel{{CIDR: "10.20.30.0/33", Label: "lab"}}, "", true},
+		{[]config.IPLabel{{CIDR: "10.20.30.0/24"}}, "", true},
+	}
+	for _, tt := range tests {
+		rules, err := ParseRules(tt.labels)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRules(%v) error = %v, want error %v", tt.labels, err, tt.wantErr)
+			continue
+		}
+		if err == nil && rules[0].Prefix.String() != tt.want {
+			t.Errorf("ParseRules(%v) prefix = %s, want %s", tt.labels, rules[0].Prefix, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ipinfo
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"speedtest/results"
+)
+
+// Cache is a size-bounded LRU cache whose entries expire after a fixed TTL.
+type Cache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	addr    string
+	info    results.IPInfoResponse
+	expires time.Time
+}
+
+// NewCache 创建最多保存 size 条记录、每条记录 ttl 后过期的缓存
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// Get 返回未过期的缓存记录并将其标记为最近使用
+func (c *Cache) Get(addr string) (results.IPInfoResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[addr]
+	if !ok {
+		return results.IPInfoResponse{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, addr)
+		return results.IPInfoResponse{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.info, true
+}
+
+// Add 添加或更新记录，超出容量时淘汰最久未使用的记录
+func (c *Cache) Add(addr string, info results.IPInfoResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if elem, ok := c.entries[addr]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.info = info
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[addr] = c.order.PushFront(&cacheEntry{addr: addr, info: info, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).addr)
+	}
+}
@@ -0,0 +1,134 @@
+package ipinfo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/results"
+)
+
+// GeoIP looks up addresses in local MaxMind-format databases
+type GeoIP struct {
+	city *maxminddb.Reader
+	asn  *maxminddb.Reader
+}
+
+// geoIPCity holds the fields used from GeoLite2-City compatible databases
+type geoIPCity struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+		TimeZone  string   `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+// geoIPASN holds the fields used from GeoLite2-ASN compatible databases
+type geoIPASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// OpenGeoIP 打开本地 GeoIP 数据库，cityPath 和 asnPath 至少需要配置一个
+func OpenGeoIP(cityPath, asnPath string) (*GeoIP, error) {
+	if cityPath == "" && asnPath == "" {
+		return nil, errors.New("geoip_city_database or geoip_asn_database must be set")
+	}
+
+	var dbs GeoIP
+	for _, db := range []struct {
+		dst  **maxminddb.Reader
+		path string
+		name string
+	}{
+		{&dbs.city, cityPath, "city"},
+		{&dbs.asn, asnPath, "ASN"},
+	} {
+		if db.path == "" {
+			continue
+		}
+		reader, err := maxminddb.Open(db.path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s database %s: %w", db.name, db.path, err)
+		}
+		log.Infof("Using GeoIP %s database %s (%s, built %d)", db.name, db.path, reader.Metadata.DatabaseType, reader.Metadata.BuildEpoch)
+		*db.dst = reader
+	}
+
+	return &dbs, nil
+}
+
+func (dbs *GeoIP) Name() string {
+	return "geoip"
+}
+
+// Lookup 从本地数据库解析 IP 地址信息，字段格式与 ipinfo.io 的响应保持一致。
+// 本地数据库无法得知服务器自身的公网地址，addr 为空时返回 ErrUnsupported，
+// 地址不在任何数据库中时返回 ErrNotFound，以便由后续的查询服务处理
+func (dbs *GeoIP) Lookup(_ context.Context, addr string) (results.IPInfoResponse, error) {
+	var ret results.IPInfoResponse
+
+	if addr == "" {
+		return ret, ErrUnsupported
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ret, fmt.Errorf("invalid IP address: %s", addr)
+	}
+	ret.IP = addr
+
+	found := false
+	if dbs.city != nil {
+		var city geoIPCity
+		_, ok, err := dbs.city.LookupNetwork(ip, &city)
+		if err != nil {
+			return ret, err
+		}
+		found = found || ok
+		ret.City = city.City.Names["en"]
+		if len(city.Subdivisions) > 0 {
+			ret.Region = city.Subdivisions[0].Names["en"]
+		}
+		ret.Country = city.Country.ISOCode
+		if city.Location.Latitude != nil && city.Location.Longitude != nil {
+			ret.Location = strconv.FormatFloat(*city.Location.Latitude, 'f', 4, 64) + "," + strconv.FormatFloat(*city.Location.Longitude, 'f', 4, 64)
+		}
+		ret.Postal = city.Postal.Code
+		ret.Timezone = city.Location.TimeZone
+	}
+
+	if dbs.asn != nil {
+		var asn geoIPASN
+		_, ok, err := dbs.asn.LookupNetwork(ip, &asn)
+		if err != nil {
+			return ret, err
+		}
+		found = found || ok
+		if asn.Number != 0 {
+			ret.Organization = fmt.Sprintf("AS%d %s", asn.Number, asn.Organization)
+		}
+	}
+
+	if !found {
+		return ret, ErrNotFound
+	}
+	return ret, nil
+}
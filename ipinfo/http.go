@@ -0,0 +1,138 @@
+package ipinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"speedtest/results"
+)
+
+// IPInfoIO looks up addresses with the ipinfo.io API.
+type IPInfoIO struct {
+	apiKey string
+	client *http.Client
+}
+
+func NewIPInfoIO(apiKey string) *IPInfoIO {
+	return &IPInfoIO{apiKey: apiKey, client: http.DefaultClient}
+}
+
+func (p *IPInfoIO) Name() string {
+	return "ipinfo"
+}
+
+func (p *IPInfoIO) Lookup(ctx context.Context, addr string) (results.IPInfoResponse, error) {
+	var ret results.IPInfoResponse
+
+	ipInfoURL := "https://ipinfo.io/json"
+	if addr != "" {
+		ipInfoURL = "https://ipinfo.io/" + url.PathEscape(addr) + "/json"
+	}
+	if p.apiKey != "" {
+		ipInfoURL += "?token=" + url.QueryEscape(p.apiKey)
+	}
+
+	err := getJSON(ctx, p.client, ipInfoURL, &ret)
+	return ret, err
+}
+
+// IPAPI looks up addresses with ip-api.com or a service with a compatible JSON API.
+type IPAPI struct {
+	urlTemplate string
+	client      *http.Client
+}
+
+// ipAPIResponse holds the fields used from ip-api.com responses
+type ipAPIResponse struct {
+	Status      string  `json:"status"`
+	Message     string  `json:"message"`
+	Query       string  `json:"query"`
+	City        string  `json:"city"`
+	RegionName  string  `json:"regionName"`
+	CountryCode string  `json:"countryCode"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Zip         string  `json:"zip"`
+	Timezone    string  `json:"timezone"`
+	ISP         string  `json:"isp"`
+	Org         string  `json:"org"`
+	AS          string  `json:"as"`
+	Reverse     string  `json:"reverse"`
+}
+
+// NewIPAPI 创建兼容 ip-api.com 的查询服务，urlTemplate 中的 {ip} 会被替换为要查询的地址
+func NewIPAPI(urlTemplate string) *IPAPI {
+	if urlTemplate == "" {
+		urlTemplate = "http://ip-api.com/json/{ip}"
+	}
+	return &IPAPI{urlTemplate: urlTemplate, client: http.DefaultClient}
+}
+
+func (p *IPAPI) Name() string {
+	return "ipapi"
+}
+
+func (p *IPAPI) Lookup(ctx context.Context, addr string) (results.IPInfoResponse, error) {
+	var ret results.IPInfoResponse
+
+	var resp ipAPIResponse
+	if err := getJSON(ctx, p.client, strings.ReplaceAll(p.urlTemplate, "{ip}", url.PathEscape(addr)), &resp); err != nil {
+		return ret, err
+	}
+	if resp.Status != "" && resp.Status != "success" {
+		return ret, fmt.Errorf("lookup failed: %s", resp.Message)
+	}
+
+	ret.IP = resp.Query
+	ret.Hostname = resp.Reverse
+	ret.City = resp.City
+	ret.Region = resp.RegionName
+	ret.Country = resp.CountryCode
+	if resp.Lat != 0 || resp.Lon != 0 {
+		ret.Location = strconv.FormatFloat(resp.Lat, 'f', 4, 64) + "," + strconv.FormatFloat(resp.Lon, 'f', 4, 64)
+	}
+	ret.Postal = resp.Zip
+	ret.Timezone = resp.Timezone
+	// ipinfo.io reports "AS1234 Name", which is what the frontend expects
+	switch {
+	case resp.AS != "":
+		ret.Organization = resp.AS
+	case resp.Org != "":
+		ret.Organization = resp.Org
+	default:
+		ret.Organization = resp.ISP
+	}
+
+	return ret, nil
+}
+
+// getJSON 请求 url 并将 JSON 响应解析到 v，非 200 状态码视为错误
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,152 @@
+package ipinfo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+	"speedtest/results"
+)
+
+const (
+	defaultTimeout = 2 * time.Second
+)
+
+var (
+	// ErrUnsupported is returned by providers that can't answer a lookup, e.g. the local
+	// databases when asked for the public address of the server itself
+	ErrUnsupported = errors.New("lookup not supported by provider")
+	// ErrNotFound is returned when a provider has no information about an address
+	ErrNotFound = errors.New("address not found")
+
+	chain *Chain
+)
+
+// Provider resolves information about an IP address. An empty address means the
+// public address the request to the provider originates from, i.e. the server itself.
+type Provider interface {
+	Name() string
+	Lookup(ctx context.Context, addr string) (results.IPInfoResponse, error)
+}
+
+// Chain asks its providers in order until one of them succeeds. Successful lookups
+// of client addresses are cached.
+type Chain struct {
+	providers []Provider
+	timeouts  []time.Duration
+	cache     *Cache
+}
+
+// Initialize 按 ipinfo_providers 的顺序创建 IP 信息查询链，未配置时在有本地数据库时使用 geoip，否则使用 ipinfo.io
+func Initialize(conf *config.Config) {
+	names := conf.IPInfoProviders
+	if len(names) == 0 {
+		// keep client addresses on the server when local databases are configured
+		if conf.GeoIPCityDatabase != "" || conf.GeoIPASNDatabase != "" {
+			names = []string{"geoip"}
+		} else {
+			names = []string{"ipinfo"}
+		}
+	}
+
+	var c Chain
+	for _, name := range names {
+		var (
+			p   Provider
+			err error
+		)
+		switch name {
+		case "ipinfo":
+			p = NewIPInfoIO(conf.IPInfoAPIKey)
+		case "ipapi":
+			p = NewIPAPI(conf.IPAPIURL)
+		case "geoip":
+			p, err = OpenGeoIP(conf.GeoIPCityDatabase, conf.GeoIPASNDatabase)
+		default:
+			err = fmt.Errorf("unknown provider %q", name)
+		}
+		if err != nil {
+			log.Fatalf("Cannot set up IP info provider %s: %s", name, err)
+		}
+
+		timeout := conf.IPInfoTimeout
+		if t, ok := conf.IPInfoProviderTimeouts[name]; ok {
+			timeout = t
+		}
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+
+		c.providers = append(c.providers, p)
+		c.timeouts = append(c.timeouts, timeout)
+	}
+
+	if conf.IPInfoCacheSize > 0 && conf.IPInfoCacheTTL > 0 {
+		c.cache = NewCache(conf.IPInfoCacheSize, conf.IPInfoCacheTTL)
+	}
+
+	log.Infof("Using IP info providers %v", names)
+	chain = &c
+}
+
+// Lookup 依次使用配置的查询服务解析 addr，addr 为空时查询服务器自身的公网地址
+func Lookup(ctx context.Context, addr string) (results.IPInfoResponse, error) {
+	if chain == nil {
+		return results.IPInfoResponse{}, errors.New("IP info providers are not initialized")
+	}
+	return chain.Lookup(ctx, addr)
+}
+
+// Lookup 先查缓存，未命中时依次尝试各查询服务直到成功，每个服务使用各自的超时时间
+func (c *Chain) Lookup(ctx context.Context, addr string) (results.IPInfoResponse, error) {
+	if addr != "" && c.cache != nil {
+		if ret, ok := c.cache.Get(addr); ok {
+			cacheLookups.WithLabelValues("hit").Inc()
+			return ret, nil
+		}
+		cacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	var errs []error
+	for i, p := range c.providers {
+		ret, err := c.lookup(ctx, p, c.timeouts[i], addr)
+		if err == nil {
+			if addr != "" && c.cache != nil {
+				c.cache.Add(addr, ret)
+			}
+			return ret, nil
+		}
+		if ctx.Err() != nil {
+			// the client is gone, the remaining providers would fail the same way
+			return results.IPInfoResponse{}, ctx.Err()
+		}
+		if !errors.Is(err, ErrUnsupported) && !errors.Is(err, ErrNotFound) {
+			log.Warnf("IP info lookup with %s failed: %s", p.Name(), err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+	}
+
+	return results.IPInfoResponse{}, errors.Join(errs...)
+}
+
+// lookup 在超时时间内使用 p 查询 addr 并记录耗时和错误指标
+func (c *Chain) lookup(ctx context.Context, p Provider, timeout time.Duration, addr string) (results.IPInfoResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	ret, err := p.Lookup(ctx, addr)
+	if errors.Is(err, ErrUnsupported) {
+		return ret, err
+	}
+
+	lookupDuration.WithLabelValues(p.Name()).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		lookupErrors.WithLabelValues(p.Name()).Inc()
+	}
+	return ret, err
+}
@@ -0,0 +1,25 @@
+package ipinfo
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "speedtest_ipinfo_lookup_duration_seconds",
+		Help:    "Latency of IP info lookups, by provider.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+	lookupErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_ipinfo_lookup_errors_total",
+		Help: "IP info lookups that failed, by provider.",
+	}, []string{"provider"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_ipinfo_cache_lookups_total",
+		Help: "IP info cache lookups, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(lookupDuration, lookupErrors, cacheLookups)
+}
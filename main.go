@@ -1,27 +1,107 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	_ "time/tzdata"
 
+	"speedtest/clientip"
 	"speedtest/config"
 	"speedtest/database"
+	"speedtest/ipclass"
+	"speedtest/ipinfo"
+	"speedtest/quota"
 	"speedtest/results"
+	"speedtest/servers"
+	"speedtest/session"
 	"speedtest/web"
 
 	_ "github.com/breml/rootcerts"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// flushTimeout bounds how long to wait for telemetry inserts still running after the HTTP server stopped
+	flushTimeout = 10 * time.Second
+)
+
 var (
 	optConfig = flag.String("c", "", "config file to be used, defaults to settings.toml in the same directory")
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [migrate]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  migrate\tcreate or upgrade the database schema and exit")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	conf := config.Load(*optConfig)
+
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		conf.DatabaseAutoMigrate = false
+		database.SetDBInfo(&conf)
+		quota.Initialize(&conf)
+		if err := database.Migrate(); err != nil {
+			log.Fatalf("Error migrating database: %s", err)
+		}
+		database.DB.Close()
+		log.Info("Database schema is up to date")
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ipinfo.Initialize(&conf)
+	ipclass.Initialize(&conf)
+	clientip.Initialize(&conf)
+	session.Initialize(&conf)
+	servers.Initialize(&conf)
 	web.SetServerLocation(&conf)
 	results.Initialize(&conf)
 	database.SetDBInfo(&conf)
-	log.Fatal(web.ListenAndServe(&conf))
+	quota.Initialize(&conf)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// a second signal terminates immediately instead of waiting for the grace period
+		<-ctx.Done()
+		stop()
+	}()
+
+	retentionDone := database.StartRetention(ctx, &conf)
+	quotaDone := quota.Start(ctx)
+	serversDone := servers.Start(ctx)
+
+	if err := web.ListenAndServe(ctx, &conf); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := results.FlushPending(flushCtx); err != nil {
+		log.Errorf("Timed out waiting for pending telemetry inserts: %s", err)
+	}
+	<-retentionDone
+	<-quotaDone
+	<-serversDone
+	// store the bytes of the tests that were still running when the signal arrived
+	quota.Flush()
+
+	if err := database.DB.Close(); err != nil {
+		log.Errorf("Error closing database: %s", err)
+	}
+	log.Info("Shutdown complete")
 }
@@ -0,0 +1,16 @@
+package quota
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	quotaFlushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_quota_flush_errors_total",
+		Help: "Quota counter updates that could not be written to the database.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(quotaFlushErrors)
+}
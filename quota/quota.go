@@ -0,0 +1,340 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+	"speedtest/database"
+	"speedtest/ratelimit"
+)
+
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+var (
+	// ErrExceeded is returned once a client has used up its daily or monthly quota
+	ErrExceeded = errors.New("transfer quota exceeded")
+
+	// tracker is nil when no quota is configured
+	tracker *Tracker
+)
+
+// Tracker counts the bytes transferred by each client. Counters are kept in memory and
+// added to the database backend by Flush.
+type Tracker struct {
+	daily, monthly int64
+	bytesPerTest   int64
+	location       *time.Location
+	ipv4Bits       int
+	ipv6Bits       int
+	// persistent is false with the none backend, the counters then stay in memory until their periods end
+	persistent bool
+
+	lock    sync.Mutex
+	clients map[netip.Prefix]*usage
+}
+
+// usage holds the counters of one client for the current day and month
+type usage struct {
+	day, month           string
+	dayBytes, monthBytes int64
+	// pending holds the bytes per period that have not been stored yet
+	pending  map[string]int64
+	lastUsed time.Time
+}
+
+// Status is the quota state of a client as returned by the quota status endpoint
+type Status struct {
+	Enabled        bool          `json:"enabled"`
+	Daily          *PeriodStatus `json:"daily,omitempty"`
+	Monthly        *PeriodStatus `json:"monthly,omitempty"`
+	TestsRemaining *int64        `json:"tests_remaining,omitempty"`
+}
+
+type PeriodStatus struct {
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Initialize 根据 quota_daily_bytes 和 quota_monthly_bytes 启用流量配额
+func Initialize(conf *config.Config) {
+	if conf.QuotaDailyBytes <= 0 && conf.QuotaMonthlyBytes <= 0 {
+		return
+	}
+
+	loc, err := time.LoadLocation(conf.QuotaTimezone)
+	if err != nil {
+		log.Fatalf("Invalid quota_timezone %s: %s", conf.QuotaTimezone, err)
+	}
+
+	tracker = &Tracker{
+		daily:        conf.QuotaDailyBytes,
+		monthly:      conf.QuotaMonthlyBytes,
+		bytesPerTest: conf.QuotaBytesPerTest,
+		location:     loc,
+		ipv4Bits:     conf.QuotaIPv4Prefix,
+		ipv6Bits:     conf.QuotaIPv6Prefix,
+		persistent:   conf.DatabaseType != "none",
+		clients:      make(map[netip.Prefix]*usage),
+	}
+	if !tracker.persistent {
+		log.Warn("database_type is none, quota counters are kept in memory and reset when the server restarts")
+	}
+	log.Infof("Enforcing transfer quotas per client (daily: %d bytes, monthly: %d bytes)", conf.QuotaDailyBytes, conf.QuotaMonthlyBytes)
+}
+
+// Enabled reports whether any quota is configured
+func Enabled() bool {
+	return tracker != nil
+}
+
+// Key 返回 addr 所属的配额前缀
+func Key(addr netip.Addr) netip.Prefix {
+	return ratelimit.Key(addr, tracker.ipv4Bits, tracker.ipv6Bits)
+}
+
+// Check 检查客户端是否还有剩余配额，没有时返回距离配额重置的时间
+func Check(key netip.Prefix) (bool, time.Duration) {
+	return Take(key, 0)
+}
+
+// Take 在客户端还有剩余配额时计入 n 个字节，计入后可以超出配额。
+// 配额已经用完时不计入，并返回距离配额重置的时间
+func Take(key netip.Prefix, n int64) (bool, time.Duration) {
+	t := tracker
+	now := time.Now().In(t.location)
+	u := t.usage(key, now)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var wait time.Duration
+	if t.daily > 0 && u.dayBytes >= t.daily {
+		wait = nextDay(now).Sub(now)
+	}
+	if t.monthly > 0 && u.monthBytes >= t.monthly {
+		wait = max(wait, nextMonth(now).Sub(now))
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	if n > 0 {
+		u.dayBytes += n
+		u.monthBytes += n
+		if t.persistent {
+			u.pending[u.day] += n
+			u.pending[u.month] += n
+		}
+	}
+	return true, 0
+}
+
+// ClientStatus 返回客户端当前的配额使用情况
+func ClientStatus(key netip.Prefix) Status {
+	t := tracker
+	if t == nil {
+		return Status{}
+	}
+
+	now := time.Now().In(t.location)
+	u := t.usage(key, now)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	status := Status{Enabled: true}
+	remaining := int64(-1)
+	for _, p := range []struct {
+		dst      **PeriodStatus
+		limit    int64
+		used     int64
+		resetsAt time.Time
+	}{
+		{&status.Daily, t.daily, u.dayBytes, nextDay(now)},
+		{&status.Monthly, t.monthly, u.monthBytes, nextMonth(now)},
+	} {
+		if p.limit <= 0 {
+			continue
+		}
+		left := max(p.limit-p.used, 0)
+		*p.dst = &PeriodStatus{Limit: p.limit, Used: p.used, Remaining: left, ResetsAt: p.resetsAt}
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+
+	if t.bytesPerTest > 0 {
+		// a test may start as long as any quota is left
+		tests := (remaining + t.bytesPerTest - 1) / t.bytesPerTest
+		status.TestsRemaining = &tests
+	}
+	return status
+}
+
+// usage 返回客户端在当前周期的计数器，必要时从数据库读取已经保存的用量
+func (t *Tracker) usage(key netip.Prefix, now time.Time) *usage {
+	day, month := now.Format(dayFormat), now.Format(monthFormat)
+
+	t.lock.Lock()
+	u, ok := t.clients[key]
+	if ok && u.day == day && u.month == month {
+		u.lastUsed = now
+		t.lock.Unlock()
+		return u
+	}
+	t.lock.Unlock()
+
+	// read outside the lock, the database may be slow
+	client := key.String()
+	dayBytes, err := database.DB.Usage(client, day)
+	if err != nil {
+		log.Errorf("Error reading quota usage of %s: %s", client, err)
+	}
+	monthBytes, err := database.DB.Usage(client, month)
+	if err != nil {
+		log.Errorf("Error reading quota usage of %s: %s", client, err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	u, ok = t.clients[key]
+	if !ok {
+		u = &usage{pending: make(map[string]int64)}
+		t.clients[key] = u
+	}
+	if u.day != day || u.month != month {
+		// pending bytes of the previous period are still written by the next Flush
+		u.day, u.month = day, month
+		u.dayBytes = dayBytes + u.pending[day]
+		u.monthBytes = monthBytes + u.pending[month]
+	}
+	u.lastUsed = now
+	return u
+}
+
+// Flush 将内存中尚未保存的用量写入数据库，并移除空闲客户端的计数器。写入失败的用量保留到下一次 Flush
+func Flush() {
+	t := tracker
+	if t == nil {
+		return
+	}
+
+	type delta struct {
+		key    netip.Prefix
+		period string
+		bytes  int64
+	}
+	var deltas []delta
+
+	now := time.Now().In(t.location)
+	day, month := now.Format(dayFormat), now.Format(monthFormat)
+	t.lock.Lock()
+	for key, u := range t.clients {
+		if !t.persistent {
+			// nothing is stored, keep the counters as long as they count against a quota
+			if (t.daily <= 0 || u.day != day) && (t.monthly <= 0 || u.month != month) {
+				delete(t.clients, key)
+			}
+			continue
+		}
+		if len(u.pending) == 0 && now.Sub(u.lastUsed) > flushInterval {
+			// stored by an earlier flush, the next request reads the counters from the database again
+			delete(t.clients, key)
+			continue
+		}
+		for period, bytes := range u.pending {
+			deltas = append(deltas, delta{key, period, bytes})
+		}
+		clear(u.pending)
+	}
+	t.lock.Unlock()
+
+	var failed []delta
+	for _, d := range deltas {
+		if err := database.DB.AddUsage(d.key.String(), d.period, d.bytes); err != nil {
+			quotaFlushErrors.Inc()
+			log.Errorf("Error storing quota usage of %s: %s", d.key, err)
+			failed = append(failed, d)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, d := range failed {
+		u, ok := t.clients[d.key]
+		if !ok {
+			// without a period the next request reads the stored counters and adds the pending bytes
+			u = &usage{pending: make(map[string]int64), lastUsed: now}
+			t.clients[d.key] = u
+		}
+		u.pending[d.period] += d.bytes
+	}
+}
+
+const (
+	// flushInterval is how often the counters are written to the database
+	flushInterval = 10 * time.Second
+)
+
+// Start 定期保存用量并删除上个月之前的计数器，ctx 取消后停止，返回的通道在停止后关闭。
+// 停止时不会保存剩余的用量，需要在所有测试结束后调用 Flush
+func Start(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	if tracker == nil {
+		close(done)
+		return done
+	}
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+
+		lastPurge := ""
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			Flush()
+
+			month := time.Now().In(tracker.location).Format(monthFormat)
+			if month != lastPurge {
+				// day and month periods of earlier months sort before the current month
+				if _, err := database.DB.PurgeUsage(month); err != nil {
+					log.Errorf("Error purging old quota usage: %s", err)
+					continue
+				}
+				lastPurge = month
+			}
+		}
+	}()
+
+	return done
+}
+
+func nextDay(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
+
+func nextMonth(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepInterval is how often buckets that have refilled completely are removed
+	sweepInterval = time.Minute
+)
+
+// Limiter is a set of token buckets, one per client prefix. Each bucket holds up to burst
+// tokens and refills at rate tokens per second.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	lock      sync.Mutex
+	buckets   map[netip.Prefix]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New 创建每秒补充 rate 个令牌、最多保存 burst 个令牌的限速器
+func New(rate, burst float64) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[netip.Prefix]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Key 返回 addr 所属的客户端前缀，IPv4 和 IPv6 地址分别按 ipv4Bits 和 ipv6Bits 长度的前缀合并，
+// 长度为 0 时使用完整地址
+func Key(addr netip.Addr, ipv4Bits, ipv6Bits int) netip.Prefix {
+	addr = addr.Unmap().WithZone("")
+	bits := ipv6Bits
+	if addr.Is4() {
+		bits = ipv4Bits
+	}
+	if bits <= 0 || bits > addr.BitLen() {
+		bits = addr.BitLen()
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// Allow 在桶中至少有 n 个令牌时取出令牌并返回 true，否则返回需要等待的时间
+func (l *Limiter) Allow(key netip.Prefix, n float64) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.bucket(key, time.Now())
+	if b.tokens < n {
+		return false, l.wait(n - b.tokens)
+	}
+	b.tokens -= n
+	return true, 0
+}
+
+// Consume 在桶中还有令牌时取出 n 个令牌，令牌数可以因此变为负数。
+// 桶已经耗尽时不取出令牌，并返回需要等待的时间
+func (l *Limiter) Consume(key netip.Prefix, n float64) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.bucket(key, time.Now())
+	if b.tokens <= 0 {
+		return false, l.wait(-b.tokens + 1)
+	}
+	b.tokens -= n
+	return true, 0
+}
+
+// bucket 返回 key 对应的桶并补充自上次使用以来的令牌，调用时需持有 l.lock
+func (l *Limiter) bucket(key netip.Prefix, now time.Time) *bucket {
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// sweep 删除已经补满的桶，它们与新建的桶没有区别
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *Limiter) wait(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		addr               string
+		ipv4Bits, ipv6Bits int
+		want               string
+	}{
+		{"192.0.2.77", 24, 64, "192.0.2.0/24"},
+		{"192.0.2.77", 32, 64, "192.0.2.77/32"},
+		{"::ffff:192.0.2.77", 24, 64, "192.0.2.0/24"},
+		{"2001:db8:1:2:3:4:5:6", 24, 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3:4:5:6", 24, 48, "2001:db8:1::/48"},
+		{"fe80::1%eth0", 24, 64, "fe80::/64"},
+		// zero or too long prefixes use the full address
+		{"192.0.2.77", 0, 0, "192.0.2.77/32"},
+		{"192.0.2.77", 40, 64, "192.0.2.77/32"},
+		{"2001:db8::1", 24, 0, "2001:db8::1/128"},
+		{"2001:db8::1", 24, 129, "2001:db8::1/128"},
+	}
+	for _, tt := range tests {
+		got := Key(netip.MustParseAddr(tt.addr), tt.ipv4Bits, tt.ipv6Bits)
+		if got.String() != tt.want {
+			t.Errorf("Key(%s, %d, %d) = %s, want %s", tt.addr, tt.ipv4Bits, tt.ipv6Bits, got, tt.want)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	// a rate this low doesn't refill noticeably while the test runs
+	l := New(0.001, 2)
+	a := netip.MustParsePrefix("192.0.2.0/24")
+	b := netip.MustParsePrefix("198.51.100.0/24")
+
+	for i, want := range []bool{true, true, false} {
+		ok, wait := l.Allow(a, 1)
+		if ok != want {
+			t.Fatalf("Allow #%d = %v, want %v", i+1, ok, want)
+		}
+		if ok && wait != 0 {
+			t.Errorf("Allow #%d returned wait %s with ok", i+1, wait)
+		}
+		if !ok && (wait < 999*time.Second || wait > 1000*time.Second) {
+			t.Errorf("Allow #%d wait = %s, want about 1000s for one token", i+1, wait)
+		}
+	}
+
+	if ok, _ := l.Allow(b, 2); !ok {
+		t.Error("buckets of different prefixes are not independent")
+	}
+	if ok, _ := l.Allow(b, 3); ok {
+		t.Error("Allow took more tokens than the bucket holds")
+	}
+}
+
+func TestConsume(t *testing.T) {
+	l := New(0.001, 1)
+	key := netip.MustParsePrefix("192.0.2.0/24")
+
+	// any token left allows the whole amount, the bucket goes negative
+	if ok, _ := l.Consume(key, 5); !ok {
+		t.Fatal("Consume with a full bucket was rejected")
+	}
+	ok, wait := l.Consume(key, 1)
+	if ok {
+		t.Fatal("Consume with an exhausted bucket was allowed")
+	}
+	// -4 tokens, one token has to be refilled on top before the next request
+	if wait < 4999*time.Second || wait > 5000*time.Second {
+		t.Errorf("wait = %s, want about 5000s", wait)
+	}
+}
+
+func TestRefillAndSweep(t *testing.T) {
+	l := New(1, 10)
+	full := netip.MustParsePrefix("192.0.2.0/24")
+	used := netip.MustParsePrefix("198.51.100.0/24")
+
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.bucket(full, now)
+	l.bucket(used, now).tokens = 0
+
+	if b := l.bucket(used, now.Add(4*time.Second)); b.tokens < 3.99 || b.tokens > 4.01 {
+		t.Errorf("tokens after 4s = %f, want 4", b.tokens)
+	}
+	if b := l.bucket(used, now.Add(time.Hour)); b.tokens != 10 {
+		t.Errorf("tokens after an hour = %f, want the burst of 10", b.tokens)
+	}
+
+	l.bucket(used, now.Add(time.Hour)).tokens = 5
+	l.sweep(now.Add(time.Hour + time.Second))
+	if _, ok := l.buckets[full]; ok {
+		t.Error("sweep kept a full bucket")
+	}
+	if _, ok := l.buckets[used]; !ok {
+		t.Error("sweep removed a bucket that hasn't refilled yet")
+	}
+}
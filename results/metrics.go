@@ -0,0 +1,37 @@
+package results
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	telemetryInserts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_telemetry_inserts_total",
+		Help: "Telemetry inserts, by database backend and result.",
+	}, []string{"backend", "result"})
+	telemetrySuspicious = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_telemetry_suspicious_total",
+		Help: "Telemetry records whose reported speeds differ too much from the server-side measurement.",
+	})
+	reportedDownload = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "speedtest_reported_download_mbps",
+		Help:    "Download speeds reported by clients, in Mbit/s.",
+		Buckets: speedBuckets,
+	})
+	reportedUpload = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "speedtest_reported_upload_mbps",
+		Help:    "Upload speeds reported by clients, in Mbit/s.",
+		Buckets: speedBuckets,
+	})
+	reportedPing = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "speedtest_reported_ping_milliseconds",
+		Help:    "Ping reported by clients, in milliseconds.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+
+	speedBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+)
+
+func init() {
+	prometheus.MustRegister(telemetryInserts, telemetrySuspicious, reportedDownload, reportedUpload, reportedPing)
+}
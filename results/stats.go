@@ -1,8 +1,13 @@
 package results
 
 import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -19,17 +24,23 @@ type StatsData struct {
 	NoPassword bool
 	LoggedIn   bool
 	Data       []schema.TelemetryData
+	NextCursor string
+}
+
+type StatsAPIResponse struct {
+	Data       []schema.TelemetryData `json:"data"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
 }
 
 var (
 	key   = []byte(securecookie.GenerateRandomKey(32))
 	store = sessions.NewCookieStore(key)
-	conf  = config.LoadedConfig()
 )
 
-func init() {
+func initializeStatsSession() {
 	store.Options = &sessions.Options{
-		Path:     conf.BaseURL + "/stats",
+		// the stats page and API are mounted below both BaseURL and /backend
+		Path:     "/",
 		MaxAge:   3600 * 1, // 1 hour
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
@@ -37,6 +48,8 @@ func init() {
 }
 
 func Stats(c *gin.Context) {
+	conf := config.LoadedConfig()
+
 	c.Header("Content-Type", "text/html; charset=utf-8")
 	t, err := template.New("template").Parse(htmlTemplate)
 	if err != nil {
@@ -66,23 +79,28 @@ func Stats(c *gin.Context) {
 				session.Values["authenticated"] = false
 				session.Options.MaxAge = -1
 				session.Save(c.Request, c.Writer)
-				c.Redirect(http.StatusTemporaryRedirect, conf.BaseURL+"/stats")
+				c.Redirect(http.StatusTemporaryRedirect, c.Request.URL.Path)
 			} else {
 				data.LoggedIn = true
 
 				id := c.Query("id")
 				switch id {
 				case "L100":
-					stats, err := database.DB.FetchLast100()
+					page, err := database.DB.Query(schema.Query{Cursor: c.Query("cursor")})
 					if err != nil {
 						log.Errorf("Error fetching data from database: %s", err)
 						c.String(http.StatusInternalServerError, "Internal Server Error")
 						return
 					}
-					data.Data = stats
+					data.Data = page.Records
+					data.NextCursor = page.NextCursor
 				case "":
 				default:
 					stat, err := database.DB.FetchByUUID(id)
+					if errors.Is(err, schema.ErrNotFound) {
+						c.String(http.StatusNotFound, "Not Found")
+						return
+					}
 					if err != nil {
 						log.Errorf("Error fetching data from database: %s", err)
 						c.String(http.StatusInternalServerError, "Internal Server Error")
@@ -97,7 +115,7 @@ func Stats(c *gin.Context) {
 				if password == conf.StatsPassword {
 					session.Values["authenticated"] = true
 					session.Save(c.Request, c.Writer)
-					c.Redirect(http.StatusTemporaryRedirect, conf.BaseURL+"/stats")
+					c.Redirect(http.StatusTemporaryRedirect, c.Request.URL.Path)
 				} else {
 					c.String(http.StatusForbidden, "Forbidden")
 				}
@@ -111,6 +129,154 @@ func Stats(c *gin.Context) {
 	}
 }
 
+// StatsAPI returns the same records as the stats page, encoded as JSON. Clients
+// authenticate either with the stats page session cookie or with HTTP basic
+// auth, using statistics_password as the password (the username is ignored).
+func StatsAPI(c *gin.Context) {
+	conf := config.LoadedConfig()
+
+	if conf.DatabaseType == "none" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "statistics are disabled"})
+		return
+	}
+
+	if conf.StatsPassword == "PASSWORD" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "statistics_password is not set"})
+		return
+	}
+
+	if !statsAuthenticated(c, conf) {
+		c.Header("WWW-Authenticate", `Basic realm="LibreSpeed Stats"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var resp StatsAPIResponse
+
+	id := c.Query("id")
+	switch id {
+	case "", "L100":
+		q, err := parseStatsQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		page, err := database.DB.Query(q)
+		if errors.Is(err, schema.ErrInvalidQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Errorf("Error fetching data from database: %s", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+		resp.Data = page.Records
+		resp.NextCursor = page.NextCursor
+	default:
+		stat, err := database.DB.FetchByUUID(id)
+		if errors.Is(err, schema.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "record not found"})
+			return
+		}
+		if err != nil {
+			log.Errorf("Error fetching data from database: %s", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+		resp.Data = append(resp.Data, *stat)
+	}
+
+	if resp.Data == nil {
+		resp.Data = []schema.TelemetryData{}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// parseStatsQuery reads the filters of the stats API from the query string. Times are
+// RFC 3339 or Unix timestamps in seconds, speeds are in Mbit/s and ping in milliseconds.
+func parseStatsQuery(c *gin.Context) (schema.Query, error) {
+	q := schema.Query{
+		IP:     c.Query("ip"),
+		ISP:    c.Query("isp"),
+		Cursor: c.Query("cursor"),
+	}
+
+	for _, t := range []struct {
+		dst   *time.Time
+		param string
+	}{
+		{&q.From, "from"},
+		{&q.To, "to"},
+	} {
+		value := c.Query(t.param)
+		if value == "" {
+			continue
+		}
+		if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+			*t.dst = time.Unix(unix, 0)
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s: %s", t.param, value)
+		}
+		*t.dst = ts
+	}
+
+	for _, f := range []struct {
+		dst   *float64
+		param string
+	}{
+		{&q.MinDownload, "min_dl"},
+		{&q.MaxDownload, "max_dl"},
+		{&q.MinUpload, "min_ul"},
+		{&q.MaxUpload, "max_ul"},
+		{&q.MinPing, "min_ping"},
+		{&q.MaxPing, "max_ping"},
+	} {
+		value := c.Query(f.param)
+		if value == "" {
+			continue
+		}
+		v, err := schema.ParseMeasurement(value)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s: %s", f.param, value)
+		}
+		*f.dst = v
+	}
+
+	switch order := c.Query("order"); order {
+	case "", "newest":
+		q.Order = schema.NewestFirst
+	case "oldest":
+		q.Order = schema.OldestFirst
+	default:
+		return q, fmt.Errorf("invalid order: %s", order)
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil || v <= 0 {
+			return q, fmt.Errorf("invalid limit: %s", limit)
+		}
+		q.Limit = v
+	}
+
+	return q, nil
+}
+
+func statsAuthenticated(c *gin.Context, conf *config.Config) bool {
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(conf.StatsPassword)) == 1
+	}
+
+	session, _ := store.Get(c.Request, "logged")
+	auth, ok := session.Values["authenticated"].(bool)
+	return auth && ok
+}
+
 const htmlTemplate = `<!DOCTYPE html>
 <html>
 <head>
@@ -176,16 +342,25 @@ const htmlTemplate = `<!DOCTYPE html>
 	<table>
 		<tr><th>Test ID</th><td>{{ $v.UUID }}</td></tr>
 		<tr><th>Date and time</th><td>{{ $v.Timestamp }}</td></tr>
-		<tr><th>IP and ISP Info</th><td>{{ $v.IPAddress }}<br/>{{ $v.ISPInfo }}</td></tr>
+		<tr><th>IP and ISP Info</th><td>{{ $v.IPAddress }}{{ if $v.Label }} ({{ $v.Label }}){{ end }}<br/>{{ $v.ISPInfo }}</td></tr>
 		<tr><th>User agent and locale</th><td>{{ $v.UserAgent }}<br/>{{ $v.Language }}</td></tr>
-		<tr><th>Download speed</th><td>{{ $v.Download }}</td></tr>
-		<tr><th>Upload speed</th><td>{{ $v.Upload }}</td></tr>
-		<tr><th>Ping</th><td>{{ $v.Ping }}</td></tr>
-		<tr><th>Jitter</th><td>{{ $v.Jitter }}</td></tr>
+		<tr><th>Download speed</th><td>{{ printf "%.2f" $v.Download }} Mbit/s</td></tr>
+		<tr><th>Upload speed</th><td>{{ printf "%.2f" $v.Upload }} Mbit/s</td></tr>
+		<tr><th>Measured by server</th><td>{{ printf "%.2f" $v.ServerDownload }} / {{ printf "%.2f" $v.ServerUpload }} Mbit/s{{ if $v.Suspicious }} (suspicious){{ end }}</td></tr>
+		<tr><th>Ping</th><td>{{ printf "%.2f" $v.Ping }} ms</td></tr>
+		<tr><th>Jitter</th><td>{{ printf "%.2f" $v.Jitter }} ms</td></tr>
 		<tr><th>Log</th><td>{{ $v.Log }}</td></tr>
 		<tr><th>Extra info</th><td>{{ $v.Extra }}</td></tr>
 	</table>
 	{{ end }}
+	{{ if .NextCursor }}
+	<form action="stats" method="GET">
+		<input type="hidden" name="op" value="id" />
+		<input type="hidden" name="id" value="L100" />
+		<input type="hidden" name="cursor" value="{{ .NextCursor }}" />
+		<input type="submit" value="Show next 100 tests" />
+	</form>
+	{{ end }}
 {{ else }}
 	<form action="stats?op=login" method="POST">
 		<h3>Login</h3>
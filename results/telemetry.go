@@ -1,27 +1,34 @@
 package results
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
+	"math"
 	"math/rand"
-	"net"
 	"net/http"
 	"regexp"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
+	"speedtest/clientip"
 	"speedtest/config"
 	"speedtest/database"
 	"speedtest/database/schema"
+	"speedtest/ipclass"
+	"speedtest/session"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang/freetype"
 	"github.com/golang/freetype/truetype"
 	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/image/font"
 )
@@ -46,6 +53,8 @@ var (
 	ipv4Regex     = regexp.MustCompile(`(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)`)
 	ipv6Regex     = regexp.MustCompile(`(([0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,7}:|([0-9a-fA-F]{1,4}:){1,6}:[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,5}(:[0-9a-fA-F]{1,4}){1,2}|([0-9a-fA-F]{1,4}:){1,4}(:[0-9a-fA-F]{1,4}){1,3}|([0-9a-fA-F]{1,4}:){1,3}(:[0-9a-fA-F]{1,4}){1,4}|([0-9a-fA-F]{1,4}:){1,2}(:[0-9a-fA-F]{1,4}){1,5}|[0-9a-fA-F]{1,4}:((:[0-9a-fA-F]{1,4}){1,6})|:((:[0-9a-fA-F]{1,4}){1,7}|:)|fe80:(:[0-9a-fA-F]{0,4}){0,4}%[0-9a-zA-Z]{1,}|::(ffff(:0{1,4})?:)?((25[0-5]|(2[0-4]|1?[0-9])?[0-9])\.){3}(25[0-5]|(2[0-4]|1?[0-9])?[0-9])|([0-9a-fA-F]{1,4}:){1,4}:((25[0-5]|(2[0-4]|1?[0-9])?[0-9])\.){3}(25[0-5]|(2[0-4]|1?[0-9])?[0-9]))`)
 	hostnameRegex = regexp.MustCompile(`"hostname":"([^\\"]|\\")*"`)
+	// asnRegexp matches the AS number ipinfo.io puts in front of the organization name
+	asnRegexp = regexp.MustCompile(`AS\d+\s`)
 
 	fontLight, fontBold *truetype.Font
 	// Font faces
@@ -66,6 +75,14 @@ var (
 	colorISP                  = image.NewUniform(color.RGBA{40, 40, 40, 255})
 	colorWatermark            = image.NewUniform(color.RGBA{160, 160, 160, 255})
 	colorSeparator            = image.NewUniform(color.RGBA{192, 192, 192, 255})
+
+	// pendingInserts tracks telemetry records that are being written to the database. Handlers may still run
+	// after the grace period forced the connections closed, so inserts are refused once FlushPending started
+	pendingInserts struct {
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+		flushing bool
+	}
 )
 
 type Result struct {
@@ -86,7 +103,55 @@ type IPInfoResponse struct {
 	Readme       string `json:"readme"`
 }
 
+// UnmarshalJSON 把不是对象的值当作空的运营商信息，前端和旧版命令行客户端在没有查询运营商时发送 ""
+func (i *IPInfoResponse) UnmarshalJSON(b []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		*i = IPInfoResponse{}
+		return nil
+	}
+	type plain IPInfoResponse
+	return json.Unmarshal(b, (*plain)(i))
+}
+
+// ISPName 返回去掉 AS 号的运营商名称
+func (i IPInfoResponse) ISPName() string {
+	return asnRegexp.ReplaceAllString(i.Organization, "")
+}
+
+// FlushPending 拒绝新的写入并等待正在写入数据库的测试结果完成，超时后返回 ctx 的错误
+func FlushPending(ctx context.Context) error {
+	pendingInserts.lock.Lock()
+	pendingInserts.flushing = true
+	pendingInserts.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pendingInserts.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginInsert 登记一次数据库写入，FlushPending 开始后返回 false
+func beginInsert() bool {
+	pendingInserts.lock.Lock()
+	defer pendingInserts.lock.Unlock()
+	if pendingInserts.flushing {
+		return false
+	}
+	pendingInserts.wg.Add(1)
+	return true
+}
+
 func Initialize(c *config.Config) {
+	initializeStatsSession()
+
 	fLight, err := freetype.ParseFont(fontLightBytes)
 	if err != nil {
 		log.Fatalf("Error parsing NotoSansDisplay-Light font: %s", err)
@@ -149,7 +214,8 @@ func Record(c *gin.Context) {
 		return
 	}
 
-	ipAddr, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+	ipAddr := clientip.ClientIP(c.Request)
+	label, _ := ipclass.Classify(ipAddr)
 	userAgent := c.Request.UserAgent()
 	language := c.Request.Header.Get("Accept-Language")
 
@@ -161,18 +227,50 @@ func Record(c *gin.Context) {
 	logs := c.PostForm("log")
 	extra := c.PostForm("extra")
 
+	measured, ok := session.Finish(ipAddr)
+
 	if config.LoadedConfig().RedactIP {
 		ipAddr = "0.0.0.0"
-		ipv4Regex.ReplaceAllString(ispInfo, "0.0.0.0")
-		ipv4Regex.ReplaceAllString(logs, "0.0.0.0")
-		ipv6Regex.ReplaceAllString(ispInfo, "0.0.0.0")
-		ipv6Regex.ReplaceAllString(logs, "0.0.0.0")
-		hostnameRegex.ReplaceAllString(ispInfo, `"hostname":"REDACTED"`)
-		hostnameRegex.ReplaceAllString(logs, `"hostname":"REDACTED"`)
+		// labels name the client's network, e.g. an office or VPN range
+		label = ""
+		ispInfo = ipv4Regex.ReplaceAllString(ispInfo, "0.0.0.0")
+		logs = ipv4Regex.ReplaceAllString(logs, "0.0.0.0")
+		ispInfo = ipv6Regex.ReplaceAllString(ispInfo, "0.0.0.0")
+		logs = ipv6Regex.ReplaceAllString(logs, "0.0.0.0")
+		ispInfo = hostnameRegex.ReplaceAllString(ispInfo, `"hostname":"REDACTED"`)
+		logs = hostnameRegex.ReplaceAllString(logs, `"hostname":"REDACTED"`)
 	}
 
 	var record schema.TelemetryData
+	for _, m := range []struct {
+		dst   *float64
+		field string
+		value string
+	}{
+		{&record.Download, "dl", download},
+		{&record.Upload, "ul", upload},
+		{&record.Ping, "ping", ping},
+		{&record.Jitter, "jitter", jitter},
+	} {
+		v, err := schema.ParseMeasurement(m.value)
+		if err != nil {
+			log.Warnf("Rejecting telemetry with invalid %s value %q", m.field, m.value)
+			c.String(http.StatusBadRequest, "Invalid "+m.field+" value")
+			return
+		}
+		*m.dst = v
+	}
+
+	record.Version = schema.Version
+	record.ServerDownload = measured.Download
+	record.ServerUpload = measured.Upload
+	record.Suspicious = session.Suspicious(measured, record.Download, record.Upload)
+	if record.Suspicious {
+		telemetrySuspicious.Inc()
+		log.Warnf("Client reported %.2f/%.2f Mbit/s, server measured %.2f/%.2f Mbit/s (session found: %t)", record.Download, record.Upload, measured.Download, measured.Upload, ok)
+	}
 	record.IPAddress = ipAddr
+	record.Label = label
 	if ispInfo == "" {
 		record.ISPInfo = "{}"
 	} else {
@@ -181,10 +279,6 @@ func Record(c *gin.Context) {
 	record.Extra = extra
 	record.UserAgent = userAgent
 	record.Language = language
-	record.Download = download
-	record.Upload = upload
-	record.Ping = ping
-	record.Jitter = jitter
 	record.Log = logs
 
 	t := time.Now()
@@ -192,16 +286,60 @@ func Record(c *gin.Context) {
 	uuid := ulid.MustNew(ulid.Timestamp(t), entropy)
 	record.UUID = uuid.String()
 
+	if !beginInsert() {
+		c.String(http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
 	err := database.DB.Insert(&record)
+	pendingInserts.wg.Done()
 	if err != nil {
+		telemetryInserts.WithLabelValues(conf.DatabaseType, "error").Inc()
 		log.Errorf("Error inserting into database: %s", err)
 		c.String(http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
+	telemetryInserts.WithLabelValues(conf.DatabaseType, "success").Inc()
+	// 0 means the test didn't run or failed
+	for _, m := range []struct {
+		histogram prometheus.Histogram
+		value     float64
+	}{
+		{reportedDownload, record.Download},
+		{reportedUpload, record.Upload},
+		{reportedPing, record.Ping},
+	} {
+		if m.value > 0 {
+			m.histogram.Observe(m.value)
+		}
+	}
+
 	c.String(http.StatusOK, "id "+uuid.String())
 }
 
+// ispDescription 返回结果图片上显示的运营商和国家，没有运营商信息时显示 IP 标签
+func ispDescription(info IPInfoResponse, label string) string {
+	isp := info.ISPName()
+	if info.Country != "" {
+		if isp == "" {
+			isp = "Unknown ISP"
+		}
+		isp += ", " + info.Country
+	}
+	switch {
+	case isp == "":
+		return label
+	case label != "":
+		return isp + " (" + label + ")"
+	}
+	return isp
+}
+
+// formatMeasurement formats a measurement with two decimals, like the frontend displays it
+func formatMeasurement(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
 func DrawPNG(c *gin.Context) {
 	conf := config.LoadedConfig()
 
@@ -279,7 +417,7 @@ func DrawPNG(c *gin.Context) {
 
 	// ping value
 	drawer.Face = pingJitterValueFace
-	pingValue := strings.Split(record.Ping, ".")[0]
+	pingValue := strconv.FormatFloat(math.Trunc(record.Ping), 'f', 0, 64)
 	p = drawer.MeasureString(pingValue)
 
 	x = canvasWidth/4 - (p.Round()+msLength.Round())/2
@@ -294,11 +432,12 @@ func DrawPNG(c *gin.Context) {
 
 	// jitter value
 	drawer.Face = pingJitterValueFace
-	p = drawer.MeasureString(record.Jitter)
+	jitterValue := formatMeasurement(record.Jitter)
+	p = drawer.MeasureString(jitterValue)
 	x = canvasWidth*3/4 - (p.Round()+msLength.Round())/2
 	drawer.Dot = freetype.Pt(x, canvasHeight*11/40)
 	drawer.Src = colorJitter
-	drawer.DrawString(record.Jitter)
+	drawer.DrawString(jitterValue)
 	drawer.Face = smallLabelFace
 	x = x + p.Round()
 	drawer.Dot = freetype.Pt(x, canvasHeight*11/40)
@@ -307,18 +446,20 @@ func DrawPNG(c *gin.Context) {
 
 	// download value
 	drawer.Face = upDownValueFace
-	p = drawer.MeasureString(record.Download)
+	downloadValue := formatMeasurement(record.Download)
+	p = drawer.MeasureString(downloadValue)
 	x = canvasWidth/4 - p.Round()/2
 	drawer.Dot = freetype.Pt(x, canvasHeight*27/40-middleOffset)
 	drawer.Src = colorDownload
-	drawer.DrawString(record.Download)
+	drawer.DrawString(downloadValue)
 
 	// upload value
-	p = drawer.MeasureString(record.Upload)
+	uploadValue := formatMeasurement(record.Upload)
+	p = drawer.MeasureString(uploadValue)
 	x = canvasWidth*3/4 - p.Round()/2
 	drawer.Dot = freetype.Pt(x, canvasHeight*27/40-middleOffset)
 	drawer.Src = colorUpload
-	drawer.DrawString(record.Upload)
+	drawer.DrawString(uploadValue)
 
 	// watermark
 	ctx := freetype.NewContext()
@@ -349,15 +490,7 @@ func DrawPNG(c *gin.Context) {
 	drawer.Face = ispFace
 	drawer.Src = colorISP
 	drawer.Dot = freetype.Pt(8, canvasHeight-ctx.PointToFixed(6).Round()-ispOffset)
-	var ispString string
-	if strings.Contains(result.ProcessedString, "-") {
-		str := strings.SplitN(result.ProcessedString, "-", 2)
-		if strings.Contains(str[1], "(") {
-			str = strings.SplitN(str[1], "(", 2)
-		}
-		ispString = str[0]
-	}
-	drawer.DrawString("ISP: " + ispString)
+	drawer.DrawString("ISP: " + ispDescription(result.RawISPInfo, record.Label))
 
 	c.Header("Content-Disposition", "inline; filename="+uuid+".png")
 	c.Header("Content-Type", "image/png")
@@ -0,0 +1,54 @@
+package results
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestISPDescription(t *testing.T) {
+	tests := []struct {
+		info  IPInfoResponse
+		label string
+		want  string
+	}{
+		{IPInfoResponse{Organization: "AS3320 Deutsche Telekom AG", Country: "DE"}, "", "Deutsche Telekom AG, DE"},
+		{IPInfoResponse{Organization: "AS3320 Deutsche Telekom AG", Country: "DE"}, "HQ Wi-Fi", "Deutsche Telekom AG, DE (HQ Wi-Fi)"},
+		{IPInfoResponse{Organization: "AS7018 AT&T Services, Inc. - Dallas"}, "", "AT&T Services, Inc. - Dallas"},
+		{IPInfoResponse{Country: "US"}, "", "Unknown ISP, US"},
+		{IPInfoResponse{}, "private IPv4 access", "private IPv4 access"},
+		{IPInfoResponse{}, "", ""},
+	}
+	for _, tt := range tests {
+		if got := ispDescription(tt.info, tt.label); got != tt.want {
+			t.Errorf("ispDescription(%+v, %q) = %q, want %q", tt.info, tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestResultUnmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want IPInfoResponse
+	}{
+		{`{"processedString":"192.0.2.1","rawIspInfo":{"org":"AS64496 Example","country":"DE"}}`, IPInfoResponse{Organization: "AS64496 Example", Country: "DE"}},
+		{`{"processedString":"192.0.2.1","rawIspInfo":""}`, IPInfoResponse{}},
+		{`{"processedString":"192.0.2.1","rawIspInfo":{}}`, IPInfoResponse{}},
+		{`{"processedString":"192.0.2.1","rawIspInfo":null}`, IPInfoResponse{}},
+		{`{"processedString":"192.0.2.1"}`, IPInfoResponse{}},
+	}
+	for _, tt := range tests {
+		var result Result
+		if err := json.Unmarshal([]byte(tt.in), &result); err != nil {
+			t.Errorf("Unmarshal(%s): %s", tt.in, err)
+			continue
+		}
+		if result.RawISPInfo != tt.want {
+			t.Errorf("Unmarshal(%s): rawIspInfo %+v, want %+v", tt.in, result.RawISPInfo, tt.want)
+		}
+	}
+
+	var result Result
+	if err := json.Unmarshal([]byte(`{"rawIspInfo":{"org":1}}`), &result); err == nil {
+		t.Error("Unmarshal accepted a number as organization")
+	}
+}
@@ -62,8 +62,6 @@ install -dm750                         %{buildroot}/var/lib/%{name}
 
 install -d                                                 %{buildroot}/%{_datadir}/%{name}
 cp -r assets                                               %{buildroot}/%{_datadir}/%{name}
-install -m644 database/mysql/telemetry_mysql.sql           %{buildroot}/%{_datadir}/%{name}
-install -m644 database/postgresql/telemetry_postgresql.sql %{buildroot}/%{_datadir}/%{name}
 popd
 
 %files
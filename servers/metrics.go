@@ -0,0 +1,20 @@
+package servers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	probeHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_server_healthy",
+		Help: "Whether the last probe of a server in the server list succeeded, by server.",
+	}, []string{"server"})
+	probeLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_server_latency_seconds",
+		Help: "Round-trip time of the last successful probe of a server in the server list, by server.",
+	}, []string{"server"})
+)
+
+func init() {
+	prometheus.MustRegister(probeHealthy, probeLatency)
+}
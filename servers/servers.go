@@ -0,0 +1,245 @@
+package servers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+)
+
+var (
+	// registry is nil when no servers are configured
+	registry *Registry
+)
+
+// Server is an entry of the server list, in the format expected by loadServerList of speedtest.js
+type Server struct {
+	ID       int     `json:"id"`
+	Name     string  `json:"name"`
+	Server   string  `json:"server"`
+	DlURL    string  `json:"dlURL"`
+	UlURL    string  `json:"ulURL"`
+	PingURL  string  `json:"pingURL"`
+	GetIpURL string  `json:"getIpURL"`
+	Location string  `json:"location,omitempty"`
+	Lat      float64 `json:"lat,omitempty"`
+	Lng      float64 `json:"lng,omitempty"`
+	// Latency is the round-trip time of the last probe in milliseconds
+	Latency float64 `json:"latency,omitempty"`
+}
+
+// Registry probes the configured servers in the background
+type Registry struct {
+	client   *http.Client
+	interval time.Duration
+	timeout  time.Duration
+
+	lock    sync.RWMutex
+	entries []*entry
+}
+
+// entry is a configured server and the state of its last probe
+type entry struct {
+	Server
+	probeURL string
+	// probed is false until the first probe finished, servers are listed until then
+	probed  bool
+	healthy bool
+}
+
+// Initialize 根据配置的 [[servers]] 创建服务器列表，没有配置服务器时不启用
+func Initialize(conf *config.Config) {
+	if len(conf.Servers) == 0 {
+		return
+	}
+	if conf.ServerProbeInterval <= 0 || conf.ServerProbeTimeout <= 0 {
+		log.Fatal("server_probe_interval and server_probe_timeout must be positive")
+	}
+
+	r := &Registry{
+		client:   &http.Client{Timeout: conf.ServerProbeTimeout},
+		interval: conf.ServerProbeInterval,
+		timeout:  conf.ServerProbeTimeout,
+	}
+	for i, s := range conf.Servers {
+		e, err := newEntry(i+1, s)
+		if err != nil {
+			log.Fatalf("Invalid server %q: %s", s.Name, err)
+		}
+		r.entries = append(r.entries, e)
+	}
+
+	registry = r
+	log.Infof("Serving a list of %d servers, probed every %s", len(r.entries), r.interval)
+}
+
+func newEntry(id int, s config.Server) (*entry, error) {
+	if s.Name == "" || s.Server == "" {
+		return nil, fmt.Errorf("name and server must be set")
+	}
+
+	e := &entry{Server: Server{
+		ID:       id,
+		Name:     s.Name,
+		Server:   s.Server,
+		DlURL:    orDefault(s.DownloadURL, "backend/garbage"),
+		UlURL:    orDefault(s.UploadURL, "backend/empty"),
+		PingURL:  orDefault(s.PingURL, "backend/empty"),
+		GetIpURL: orDefault(s.GetIPURL, "backend/getIP"),
+		Location: s.Location,
+		Lat:      s.Lat,
+		Lng:      s.Lng,
+	}}
+
+	// protocol-relative URLs are chosen by the browser, probe them over HTTPS
+	base := s.Server
+	if strings.HasPrefix(base, "//") {
+		base = "https:" + base
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("server must be an http, https or protocol-relative URL")
+	}
+	pingURL, err := baseURL.Parse(e.PingURL)
+	if err != nil {
+		return nil, err
+	}
+	e.probeURL = pingURL.String()
+
+	return e, nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// Enabled 返回是否配置了服务器列表
+func Enabled() bool {
+	return registry != nil
+}
+
+// List 返回健康的服务器，按配置的顺序排列
+func List() []Server {
+	list := []Server{}
+	if registry == nil {
+		return list
+	}
+
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	for _, e := range registry.entries {
+		if e.probed && !e.healthy {
+			continue
+		}
+		list = append(list, e.Server)
+	}
+	return list
+}
+
+// Start 立即并每隔 server_probe_interval 探测所有服务器，ctx 取消后停止并关闭返回的 channel
+func Start(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	if registry == nil {
+		close(done)
+		return done
+	}
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(registry.interval)
+		defer ticker.Stop()
+
+		for {
+			registry.probeAll(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return done
+}
+
+// probeAll 并发探测所有服务器
+func (r *Registry) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range r.entries {
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+
+			latency, err := r.probe(ctx, e.probeURL)
+			if ctx.Err() != nil {
+				return
+			}
+
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if err != nil {
+				if !e.probed || e.healthy {
+					log.Warnf("Server %s is unhealthy, removing it from the server list: %s", e.Name, err)
+				}
+				e.healthy = false
+				e.Latency = 0
+				probeHealthy.WithLabelValues(e.Name).Set(0)
+			} else {
+				if e.probed && !e.healthy {
+					log.Infof("Server %s is healthy again", e.Name)
+				}
+				e.healthy = true
+				e.Latency = float64(latency) / float64(time.Millisecond)
+				probeHealthy.WithLabelValues(e.Name).Set(1)
+				probeLatency.WithLabelValues(e.Name).Set(latency.Seconds())
+			}
+			e.probed = true
+		}(e)
+	}
+	wg.Wait()
+}
+
+// probe 请求服务器的 ping URL，返回从发送请求到收到第一个响应字节的时间
+func (r *Registry) probe(ctx context.Context, probeURL string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var wrote, firstByte time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return firstByte.Sub(wrote), nil
+}
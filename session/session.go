@@ -0,0 +1,184 @@
+package session
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+)
+
+// Direction is the direction of a test stream as seen from the client
+type Direction int
+
+const (
+	Download Direction = iota
+	Upload
+)
+
+var (
+	tracker = New(time.Minute, 0.5)
+)
+
+// Tracker groups the test streams of each client into sessions. A session ends when the client
+// submits its results, or when no stream has been seen for the idle timeout.
+type Tracker struct {
+	idle      time.Duration
+	tolerance float64
+
+	lock      sync.Mutex
+	sessions  map[string]*session
+	lastSweep time.Time
+}
+
+type session struct {
+	streams  [2]streams
+	lastSeen time.Time
+}
+
+// streams accumulates the streams of one direction
+type streams struct {
+	count       int
+	bytes       int64
+	first, last time.Time
+}
+
+// Result is the throughput the server measured during a session, in Mbit/s
+type Result struct {
+	Download        float64
+	Upload          float64
+	DownloadStreams int
+	UploadStreams   int
+}
+
+// New 创建会话跟踪器，idle 为会话的空闲超时时间，tolerance 为客户端与服务器测得速度允许的相对偏差
+func New(idle time.Duration, tolerance float64) *Tracker {
+	return &Tracker{
+		idle:      idle,
+		tolerance: tolerance,
+		sessions:  make(map[string]*session),
+		lastSweep: time.Now(),
+	}
+}
+
+// Initialize 根据 measurement_session_timeout 和 measurement_tolerance 创建全局会话跟踪器
+func Initialize(conf *config.Config) {
+	idle := conf.MeasurementSessionTimeout
+	if idle <= 0 {
+		idle = time.Minute
+	}
+	tracker = New(idle, conf.MeasurementTolerance)
+	log.Infof("Measuring test sessions on the server, flagging results that differ by more than %.0f%%", conf.MeasurementTolerance*100)
+}
+
+// AddStream 使用全局跟踪器记录一个测试流
+func AddStream(client string, dir Direction, start, end time.Time, bytes int64) {
+	tracker.AddStream(client, dir, start, end, bytes)
+}
+
+// Finish 使用全局跟踪器结束客户端的会话
+func Finish(client string) (Result, bool) {
+	return tracker.Finish(client)
+}
+
+// Suspicious 使用全局跟踪器的容差检查客户端报告的速度
+func Suspicious(r Result, download, upload float64) bool {
+	return tracker.Suspicious(r, download, upload)
+}
+
+// AddStream 将 client 从 start 到 end 传输的 bytes 个字节计入其当前会话，没有传输数据的请求（例如 ping）会被忽略
+func (t *Tracker) AddStream(client string, dir Direction, start, end time.Time, bytes int64) {
+	if client == "" || bytes <= 0 {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) >= t.idle {
+		t.sweep(now)
+	}
+
+	s, ok := t.sessions[client]
+	if !ok || now.Sub(s.lastSeen) > t.idle {
+		s = &session{}
+		t.sessions[client] = s
+	}
+	s.lastSeen = now
+
+	st := &s.streams[dir]
+	if st.count == 0 || start.Before(st.first) {
+		st.first = start
+	}
+	if end.After(st.last) {
+		st.last = end
+	}
+	st.count++
+	st.bytes += bytes
+}
+
+// Finish 结束 client 的会话并返回服务器测得的吞吐量。多个并行测试流的字节数合并后
+// 除以从第一个流开始到最后一个流结束的时间
+func (t *Tracker) Finish(client string) (Result, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, ok := t.sessions[client]
+	if !ok {
+		return Result{}, false
+	}
+	delete(t.sessions, client)
+	if time.Since(s.lastSeen) > t.idle {
+		return Result{}, false
+	}
+
+	return Result{
+		Download:        s.streams[Download].mbps(),
+		Upload:          s.streams[Upload].mbps(),
+		DownloadStreams: s.streams[Download].count,
+		UploadStreams:   s.streams[Upload].count,
+	}, true
+}
+
+// Suspicious 判断客户端报告的速度是否可疑：服务器没有测到对应方向的数据，
+// 或者两者的差异超过了服务器测得速度的 tolerance 倍
+func (t *Tracker) Suspicious(r Result, download, upload float64) bool {
+	for _, m := range []struct {
+		client, server float64
+	}{
+		{download, r.Download},
+		{upload, r.Upload},
+	} {
+		if m.client <= 0 {
+			continue
+		}
+		if m.server <= 0 {
+			return true
+		}
+		if m.client > m.server*(1+t.tolerance) || m.client < m.server*(1-t.tolerance) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweep 删除空闲超时的会话，调用时需持有 t.lock
+func (t *Tracker) sweep(now time.Time) {
+	for client, s := range t.sessions {
+		if now.Sub(s.lastSeen) > t.idle {
+			delete(t.sessions, client)
+		}
+	}
+	t.lastSweep = now
+}
+
+// mbps 返回以 Mbit/s 为单位的吞吐量，与前端一样 1 Mbit 为 1,000,000 位
+func (s streams) mbps() float64 {
+	elapsed := s.last.Sub(s.first).Seconds()
+	if s.count == 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(s.bytes) * 8 / 1e6 / elapsed
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"speedtest/config"
+)
+
+// newACMEManager 创建自动申请和续期证书的 autocert.Manager，
+// 证书通过 TLS 监听器上的 TLS-ALPN-01 质询完成验证
+func newACMEManager(conf *config.Config) (*autocert.Manager, error) {
+	if len(conf.ACMEDomains) == 0 {
+		return nil, errors.New("enable_acme requires at least one domain in acme_domains")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.ACMEDomains...),
+		Email:      conf.ACMEEmail,
+	}
+
+	if conf.ACMECacheDir != "" {
+		m.Cache = autocert.DirCache(conf.ACMECacheDir)
+	} else {
+		log.Warn("acme_cache_dir is not set, certificates will be requested again on every start")
+	}
+
+	if conf.ACMEDirectoryURL != "" || conf.ACMEDirectoryCAFile != "" {
+		client := &acme.Client{DirectoryURL: conf.ACMEDirectoryURL}
+		if conf.ACMEDirectoryCAFile != "" {
+			httpClient, err := newACMEHTTPClient(conf.ACMEDirectoryCAFile)
+			if err != nil {
+				return nil, err
+			}
+			client.HTTPClient = httpClient
+		}
+		m.Client = client
+	}
+
+	directory := conf.ACMEDirectoryURL
+	if directory == "" {
+		directory = autocert.DefaultACMEDirectory
+	}
+	log.Infof("Using ACME directory %s for domains %v", directory, conf.ACMEDomains)
+
+	return m, nil
+}
+
+// newACMEHTTPClient 返回信任 caFile 中证书的 HTTP 客户端，用于连接使用私有 CA 的 ACME 服务（例如 Pebble）
+func newACMEHTTPClient(caFile string) (*http.Client, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read acme_directory_ca_file: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in acme_directory_ca_file %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// newACMETLSConfig 返回从 ACME 获取证书的 TLS 配置
+func newACMETLSConfig(conf *config.Config) (*tls.Config, error) {
+	m, err := newACMEManager(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := m.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	if conf.EnableHTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	} else {
+		tlsConfig.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	}
+
+	return tlsConfig, nil
+}
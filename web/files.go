@@ -0,0 +1,159 @@
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/clientip"
+	"speedtest/config"
+	"speedtest/session"
+)
+
+var (
+	// testFiles maps the names of the test files to their sizes
+	testFiles = map[string]int64{}
+
+	sizeUnits = []struct {
+		suffix string
+		factor int64
+	}{
+		// binary units first, "MiB" would otherwise match "B"
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+)
+
+// initializeTestFiles 根据配置创建 /files 下的测试文件，文件名为大小加上 .bin 后缀
+func initializeTestFiles(conf *config.Config) {
+	for _, s := range conf.TestFiles {
+		size, err := parseSize(s)
+		if err != nil {
+			log.Fatalf("Invalid test file size %q: %s", s, err)
+		}
+		testFiles[s+".bin"] = size
+	}
+}
+
+// parseSize 解析带单位的大小，例如 100MB（10^6 字节）或 512MiB（2^20 字节），没有单位时为字节数
+func parseSize(s string) (int64, error) {
+	number, factor := s, int64(1)
+	for _, u := range sizeUnits {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			number, factor = n, u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 || n > (1<<62)/factor {
+		return 0, errors.New("size out of range")
+	}
+	return n * factor, nil
+}
+
+// testFile 处理对/files/:name的请求，返回固定大小的随机数据，支持 Range 请求以便断点续传
+func testFile(c *gin.Context) {
+	name := c.Param("name")
+	size, ok := testFiles[name]
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	activeStreams.WithLabelValues("files").Inc()
+	defer activeStreams.WithLabelValues("files").Dec()
+
+	r := newFileReader(name, size)
+	start := time.Now()
+	defer func() {
+		garbageBytes.Add(float64(r.read))
+		session.AddStream(clientip.ClientIP(c.Request), session.Download, start, time.Now(), r.read)
+	}()
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Cache-Control", "no-store")
+	c.Header("ETag", fmt.Sprintf(`"%s-%d"`, name, size))
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, r)
+}
+
+// fileReader generates the content of a test file from an AES-CTR keystream keyed by the file name and size.
+// The content is the same for every request and server, so downloads can be resumed at any offset.
+type fileReader struct {
+	block cipher.Block
+	size  int64
+	pos   int64
+	// stream is created at pos on the first Read after a Seek
+	stream cipher.Stream
+	// read counts the bytes returned by Read
+	read int64
+}
+
+func newFileReader(name string, size int64) *fileReader {
+	seed := sha256.Sum256([]byte(fmt.Sprintf("speedtest test file %s %d", name, size)))
+	block, err := aes.NewCipher(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	return &fileReader{block: block, size: size}
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-r.pos {
+		p = p[:r.size-r.pos]
+	}
+
+	if r.stream == nil {
+		// the keystream of block n is encrypted with the counter n, skip to the offset inside the block
+		var iv [aes.BlockSize]byte
+		binary.BigEndian.PutUint64(iv[8:], uint64(r.pos/aes.BlockSize))
+		r.stream = cipher.NewCTR(r.block, iv[:])
+		var skip [aes.BlockSize]byte
+		r.stream.XORKeyStream(skip[:r.pos%aes.BlockSize], skip[:r.pos%aes.BlockSize])
+	}
+
+	// the buffer is cleared, so that the same offset always has the same content
+	clear(p)
+	r.stream.XORKeyStream(p, p)
+	r.pos += int64(len(p))
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.pos {
+		r.pos = offset
+		r.stream = nil
+	}
+	return offset, nil
+}
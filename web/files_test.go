@@ -0,0 +1,290 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"speedtest/config"
+	"speedtest/ratelimit"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"100MB", 100e6, false},
+		{"1GB", 1e9, false},
+		{"512MiB", 512 << 20, false},
+		{"4KiB", 4096, false},
+		{"2TB", 2e12, false},
+		{"1000B", 1000, false},
+		{"1000", 1000, false},
+		{"0MB", 0, true},
+		{"-1MB", 0, true},
+		{"1.5GB", 0, true},
+		{"MB", 0, true},
+		{"1PB", 0, true},
+		{"5000000TiB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// readFile 以不对齐分组长度的块读取整个测试文件
+func readFile(t *testing.T, name string, size int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	r := newFileReader(name, size)
+	chunk := make([]byte, 7)
+	for {
+		n, err := r.Read(chunk)
+		buf.Write(chunk[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.read != size {
+		t.Errorf("read = %d, want %d", r.read, size)
+	}
+	return buf.Bytes()
+}
+
+func TestFileReaderDeterministic(t *testing.T) {
+	a := readFile(t, "1000.bin", 1000)
+	if len(a) != 1000 {
+		t.Fatalf("read %d bytes, want 1000", len(a))
+	}
+	if b := readFile(t, "1000.bin", 1000); !bytes.Equal(a, b) {
+		t.Error("the same file has different content")
+	}
+	if b := readFile(t, "1000B.bin", 1000); bytes.Equal(a, b) {
+		t.Error("files with different names have the same content")
+	}
+	if bytes.Equal(a[:16], a[16:32]) {
+		t.Error("the keystream repeats")
+	}
+}
+
+func TestFileReaderSeek(t *testing.T) {
+	const size = 1000
+	full := readFile(t, "1000.bin", size)
+
+	tests := []struct {
+		offset  int64
+		whence  int
+		wantPos int64
+	}{
+		{0, io.SeekStart, 0},
+		{1, io.SeekStart, 1},
+		{15, io.SeekStart, 15},
+		{16, io.SeekStart, 16},
+		{17, io.SeekStart, 17},
+		{999, io.SeekStart, 999},
+		{-100, io.SeekEnd, 900},
+		{0, io.SeekEnd, size},
+		{size + 10, io.SeekStart, size + 10},
+	}
+	for _, tt := range tests {
+		r := newFileReader("1000.bin", size)
+		// read first, so that the keystream has to be restarted at the new position
+		r.Read(make([]byte, 33))
+		pos, err := r.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.wantPos {
+			t.Errorf("Seek(%d, %d) = %d, %v, want %d", tt.offset, tt.whence, pos, err, tt.wantPos)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := full[min(pos, size):]
+		if !bytes.Equal(got, want) {
+			t.Errorf("content after Seek(%d, %d) differs from offset %d of the file", tt.offset, tt.whence, pos)
+		}
+	}
+
+	r := newFileReader("1000.bin", size)
+	r.Read(make([]byte, 100))
+	if pos, err := r.Seek(-30, io.SeekCurrent); err != nil || pos != 70 {
+		t.Errorf("Seek(-30, SeekCurrent) = %d, %v, want 70", pos, err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+	if _, err := r.Seek(0, 42); err == nil {
+		t.Error("Seek with an invalid whence succeeded")
+	}
+}
+
+// newTestFileRouter 创建配置了 1000B 和 4KiB 两个测试文件的路由
+func newTestFileRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	conf := &config.Config{TestFiles: []string{"1000B", "4KiB"}}
+	testFiles = map[string]int64{}
+	initializeTestFiles(conf)
+	r, err := newRouter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func serveTestFile(r *gin.Engine, method, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTestFileRoute(t *testing.T) {
+	r := newTestFileRouter(t)
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantSize int
+	}{
+		{"/backend/files/1000B.bin", http.StatusOK, 1000},
+		{"/files/1000B.bin", http.StatusOK, 1000},
+		{"/backend/files/4KiB.bin", http.StatusOK, 4096},
+		{"/backend/files/1000B", http.StatusNotFound, 0},
+		{"/backend/files/100MB.bin", http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		w := serveTestFile(r, http.MethodGet, tt.path, nil)
+		if w.Code != tt.wantCode {
+			t.Errorf("GET %s: status %d, want %d", tt.path, w.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		if w.Body.Len() != tt.wantSize || w.Header().Get("Content-Length") != strconv.Itoa(tt.wantSize) {
+			t.Errorf("GET %s: %d bytes, Content-Length %s, want %d", tt.path, w.Body.Len(), w.Header().Get("Content-Length"), tt.wantSize)
+		}
+		for header, want := range map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Cache-Control": "no-store",
+			"Accept-Ranges": "bytes",
+			"ETag":          fmt.Sprintf(`"%s-%d"`, path.Base(tt.path), tt.wantSize),
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("GET %s: %s = %q, want %q", tt.path, header, got, want)
+			}
+		}
+	}
+
+	w := serveTestFile(r, http.MethodHead, "/backend/files/1000B.bin", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD: status %d with %d bytes, want 200 without a body", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("Content-Length") != "1000" || w.Header().Get("ETag") != `"1000B.bin-1000"` {
+		t.Errorf("HEAD: Content-Length %q, ETag %q", w.Header().Get("Content-Length"), w.Header().Get("ETag"))
+	}
+}
+
+func TestTestFileRange(t *testing.T) {
+	const size = 1000
+	full := readFile(t, "1000B.bin", size)
+	r := newTestFileRouter(t)
+
+	tests := []struct {
+		rangeHeader string
+		ifRange     string
+		wantStatus  int
+		want        []byte
+	}{
+		{"", "", http.StatusOK, full},
+		{"bytes=0-99", "", http.StatusPartialContent, full[:100]},
+		{"bytes=100-199", "", http.StatusPartialContent, full[100:200]},
+		{"bytes=990-", "", http.StatusPartialContent, full[990:]},
+		{"bytes=-10", "", http.StatusPartialContent, full[990:]},
+		{"bytes=995-2000", "", http.StatusPartialContent, full[995:]},
+		{"bytes=1000-", "", http.StatusRequestedRangeNotSatisfiable, nil},
+		// resuming only continues the same file
+		{"bytes=500-", `"1000B.bin-1000"`, http.StatusPartialContent, full[500:]},
+		{"bytes=500-", `"1000B.bin-999"`, http.StatusOK, full},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.rangeHeader != "" {
+			header.Set("Range", tt.rangeHeader)
+		}
+		if tt.ifRange != "" {
+			header.Set("If-Range", tt.ifRange)
+		}
+		w := serveTestFile(r, http.MethodGet, "/backend/files/1000B.bin", header)
+		if w.Code != tt.wantStatus {
+			t.Errorf("Range %q, If-Range %q: status %d, want %d", tt.rangeHeader, tt.ifRange, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.want != nil && !bytes.Equal(w.Body.Bytes(), tt.want) {
+			t.Errorf("Range %q, If-Range %q: body differs from the file content", tt.rangeHeader, tt.ifRange)
+		}
+	}
+
+	w := serveTestFile(r, http.MethodGet, "/backend/files/1000B.bin", http.Header{"Range": {"bytes=0-9,500-509"}})
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || err != nil {
+		t.Fatalf("multipart range: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range [][]byte{full[0:10], full[500:510]} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(part)
+		if !bytes.Equal(got, want) {
+			t.Errorf("multipart range %s: body differs from the file content", strings.TrimSpace(part.Header.Get("Content-Range")))
+		}
+	}
+}
+
+func TestTestFileLimits(t *testing.T) {
+	r := newTestFileRouter(t)
+
+	draining.Store(true)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if w := serveTestFile(r, method, "/backend/files/1000B.bin", nil); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s while draining: status %d, want 503", method, w.Code)
+		}
+	}
+	draining.Store(false)
+
+	testLimiter = ratelimit.New(0.001, 1)
+	t.Cleanup(func() { testLimiter = nil })
+	if w := serveTestFile(r, http.MethodHead, "/backend/files/1000B.bin", nil); w.Code != http.StatusOK {
+		t.Fatalf("first HEAD: status %d, want 200", w.Code)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if w := serveTestFile(r, method, "/backend/files/1000B.bin", nil); w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s after the test limit: status %d, want 429", method, w.Code)
+		}
+	}
+}
@@ -2,12 +2,26 @@ package web
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
 	"speedtest/config"
 
-	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 )
 
-func GinRoute(conf *config.Config, r *gin.Engine) error {
+// GinRoute 在配置的地址和端口上启动 srv
+func GinRoute(conf *config.Config, srv *http.Server) error {
+	// 检查是否使用 systemd socket 激活启动进程
+	listeners, err := activatedListeners()
+	if err != nil {
+		return fmt.Errorf("error whilst checking for systemd socket activation: %w", err)
+	}
+	if len(listeners) > 0 {
+		return serveActivated(conf, srv, listeners)
+	}
+
 	var (
 		addr string
 		port int
@@ -22,5 +36,13 @@ func GinRoute(conf *config.Config, r *gin.Engine) error {
 	} else {
 		port = conf.Port
 	}
-	return r.Run(fmt.Sprintf("%s:%d", addr, port))
+
+	listenAddr := net.JoinHostPort(addr, strconv.Itoa(port))
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Starting backend server on %s", listenAddr)
+	return serve(conf, srv, l)
 }
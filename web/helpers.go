@@ -1,11 +1,9 @@
 package web
 
 import (
-	"crypto/rand"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"strconv"
 	"strings"
 
@@ -13,6 +11,7 @@ import (
 	"github.com/umahmood/haversine"
 
 	"speedtest/config"
+	"speedtest/ipinfo"
 	"speedtest/results"
 )
 
@@ -20,50 +19,11 @@ var (
 	serverCoord haversine.Coord
 )
 
-func getRandomData(length int) []byte {
-	data := make([]byte, length)
-	if _, err := rand.Read(data); err != nil {
-		log.Fatalf("Failed to generate random data: %s", err)
+func getIPInfo(ctx context.Context, addr string) results.IPInfoResponse {
+	ret, err := ipinfo.Lookup(ctx, addr)
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("Error getting IP info for %s: %s", addr, err)
 	}
-	return data
-}
-
-func getIPInfoURL(address string) string {
-	apiKey := config.LoadedConfig().IPInfoAPIKey
-
-	ipInfoURL := `https://ipinfo.io/%s/json`
-	if address != "" {
-		ipInfoURL = fmt.Sprintf(ipInfoURL, address)
-	} else {
-		ipInfoURL = "https://ipinfo.io/json"
-	}
-
-	if apiKey != "" {
-		ipInfoURL += "?token=" + apiKey
-	}
-
-	return ipInfoURL
-}
-
-func getIPInfo(addr string) results.IPInfoResponse {
-	var ret results.IPInfoResponse
-	resp, err := http.DefaultClient.Get(getIPInfoURL(addr))
-	if err != nil {
-		log.Errorf("Error getting response from ipinfo.io: %s", err)
-		return ret
-	}
-	defer resp.Body.Close()
-
-	raw, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Errorf("Error reading response from ipinfo.io: %s", err)
-		return ret
-	}
-
-	if err := json.Unmarshal(raw, &ret); err != nil {
-		log.Errorf("Error parsing response from ipinfo.io: %s", err)
-	}
-
 	return ret
 }
 
@@ -75,27 +35,19 @@ func SetServerLocation(conf *config.Config) {
 		return
 	}
 
-	resp, err := http.DefaultClient.Get(getIPInfoURL(""))
-	if err != nil {
-		log.Errorf("Error getting response from ipinfo.io: %s", err)
+	ipInfo, err := ipinfo.Lookup(context.Background(), "")
+	if errors.Is(err, ipinfo.ErrUnsupported) {
+		// local databases don't know the public address of the server
+		log.Warn("Server coordinates are not configured, set server_lat and server_lng to show distances when using GeoIP databases")
 		return
 	}
-	defer resp.Body.Close()
-
-	raw, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Errorf("Error reading response from ipinfo.io: %s", err)
-		return
-	}
-
-	var ipInfo results.IPInfoResponse
-	if err := json.Unmarshal(raw, &ipInfo); err != nil {
-		log.Errorf("Error parsing response from ipinfo.io: %s", err)
+		log.Errorf("Error getting server IP info: %s", err)
 		return
 	}
 
 	if ipInfo.Location == "" {
-		log.Errorf("Location not found in ipinfo.io response")
+		log.Errorf("Location not found in server IP info")
 		return
 	}
 
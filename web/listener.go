@@ -1,35 +1,126 @@
-//go:build !linux
-// +build !linux
-
 package web
 
-/*
-func startListener(conf *config.Config, r *gin.Engine) error {
-	var s error
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 
-	addr := net.JoinHostPort(conf.BindAddress, conf.Port)
-	log.Infof("Starting backend server on %s", addr)
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 
-	// TLS and HTTP/2.
-	if conf.EnableTLS {
-		log.Info("Use TLS connection.")
-		if !conf.EnableHTTP2 {
-			srv := &http.Server{
-				Addr:         addr,
-				Handler:      r,
-				TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-			}
-			s = srv.ListenAndServeTLS(conf.TLSCertFile, conf.TLSKeyFile)
-		} else {
-			s = http.ListenAndServeTLS(addr, conf.TLSCertFile, conf.TLSKeyFile, r)
+	"speedtest/config"
+)
+
+// newServer 根据配置创建 HTTP 服务器，启用 TLS 时加载证书并根据 enable_http2 决定是否协商 HTTP/2，明文 HTTP 总是接受 h2c
+func newServer(conf *config.Config, r *gin.Engine) (*http.Server, error) {
+	srv := &http.Server{}
+
+	if !conf.EnableTLS {
+		if conf.EnableACME {
+			log.Warn("enable_acme has no effect without enable_tls, certificates will not be requested")
 		}
-	} else {
 		if conf.EnableHTTP2 {
-			log.Errorf("TLS is mandatory for HTTP/2. Ignore settings that enable HTTP/2.")
+			log.Warn("TLS is mandatory for HTTP/2 in browsers, enable_http2 has no effect without enable_tls")
+		}
+		// cleartext HTTP/2 (h2c) is always accepted, browsers never use it but other clients and proxies may
+		r.UseH2C = true
+		srv.Handler = r.Handler()
+		return srv, nil
+	}
+
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	srv.TLSConfig = tlsConfig
+
+	if conf.EnableHTTP2 {
+		log.Info("Use TLS connection with HTTP/2.")
+	} else {
+		log.Info("Use TLS connection with HTTP/1.1.")
+		// a non-nil empty map disables the automatic HTTP/2 upgrade of ServeTLS
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	r.UseH2C = false
+	srv.Handler = r.Handler()
+	return srv, nil
+}
+
+// newTLSConfig 加载 tls_cert_file 与 tls_key_file 指定的证书，启用 ACME 时改为自动获取证书
+func newTLSConfig(conf *config.Config) (*tls.Config, error) {
+	if conf.EnableACME {
+		return newACMETLSConfig(conf)
+	}
+
+	if conf.TLSCertFile == "" || conf.TLSKeyFile == "" {
+		return nil, errors.New("enable_tls requires both tls_cert_file and tls_key_file to be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.EnableHTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+
+	return tlsConfig, nil
+}
+
+// serve 在给定的监听器上提供服务，启用 TLS 时使用 srv.TLSConfig 中的证书
+func serve(conf *config.Config, srv *http.Server, l net.Listener) error {
+	if conf.EnableTLS {
+		return srv.ServeTLS(l, "", "")
+	}
+	return srv.Serve(l)
+}
+
+// serveActivated 在所有通过 systemd socket 激活继承的监听器上提供服务。
+// FileDescriptorName 为 http 的套接字总是使用明文 HTTP，为 https 的套接字总是使用 TLS，
+// 其余套接字遵循 enable_tls 设置。任意一个监听器出错时返回该错误。
+func serveActivated(conf *config.Config, srv *http.Server, listeners map[string][]net.Listener) error {
+	if conf.BindAddress != "" || conf.Port != 0 {
+		log.Errorf("Both an address/port (%s:%d) has been specified in the config AND externally configured socket activation has been detected", conf.BindAddress, conf.Port)
+		return errors.New(`please deconfigure socket activation (e.g. in systemd unit files), or set both 'bind_address' and 'listen_port' to ''`)
+	}
+
+	if listeners["https"] != nil && !conf.EnableTLS {
+		return errors.New("a socket named https has been passed via systemd socket activation, but enable_tls is not set")
+	}
+
+	var count int
+	for _, ls := range listeners {
+		count += len(ls)
+	}
+	errc := make(chan error, count)
+
+	for name, ls := range listeners {
+		for _, l := range ls {
+			log.Infof("Starting backend server on inherited file descriptor %s (%s) via systemd socket activation", name, l.Addr())
+			go func(name string, l net.Listener) {
+				var err error
+				switch name {
+				case "http":
+					err = srv.Serve(l)
+				case "https":
+					err = srv.ServeTLS(l, "", "")
+				default:
+					err = serve(conf, srv, l)
+				}
+				errc <- fmt.Errorf("listener %s (%s): %w", name, l.Addr(), err)
+			}(name, l)
 		}
-		s = http.ListenAndServe(addr, r)
 	}
 
-	return s
+	return <-errc
 }
-*/
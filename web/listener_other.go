@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package web
+
+import (
+	"net"
+)
+
+// activatedListeners 在非 Linux 平台上没有 systemd socket 激活，始终返回空
+func activatedListeners() (map[string][]net.Listener, error) {
+	return nil, nil
+}
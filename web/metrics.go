@@ -0,0 +1,47 @@
+package web
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	garbageBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_garbage_bytes_total",
+		Help: "Bytes served by the download test endpoints.",
+	})
+	emptyBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "speedtest_empty_bytes_total",
+		Help: "Bytes received by the upload test endpoint.",
+	})
+	activeStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "speedtest_active_streams",
+		Help: "Download and upload test streams currently in progress, by handler.",
+	}, []string{"handler"})
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_http_requests_total",
+		Help: "HTTP requests, by route and status code.",
+	}, []string{"handler", "status"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "speedtest_rate_limited_total",
+		Help: "Test streams rejected or cut short by the per-client rate limits, by limit.",
+	}, []string{"limit"})
+)
+
+func init() {
+	prometheus.MustRegister(garbageBytes, emptyBytes, activeStreams, httpRequests, rateLimited)
+}
+
+// countRequests 按路由和状态码统计请求数量
+func countRequests(c *gin.Context) {
+	c.Next()
+
+	handler := c.FullPath()
+	if handler == "" {
+		// unmatched routes are served from the embedded assets
+		handler = "assets"
+	}
+	httpRequests.WithLabelValues(handler, strconv.Itoa(c.Writer.Status())).Inc()
+}
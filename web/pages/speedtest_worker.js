@@ -51,6 +51,8 @@ let settings = {
 	url_ul: "backend/empty",
 	//url_ping: "backend/empty.php", // path to an empty file, used for ping test. must be relative to this js file
 	url_ping: "backend/empty",
+	url_ws: "backend/ws", // path to the WebSocket endpoint relative to this js file, used if websocket is enabled
+	websocket: false, // if set to true, download, upload and ping are measured over a single WebSocket connection to url_ws instead of XHR. Falls back to XHR if the connection cannot be opened
 	//url_getIp: "backend/getIP.php", // path to getIP.php relative to this js file, or a similar thing that outputs the client's ip
 	url_getIp: "backend/getIP",
 	getIp_ispInfo: true, //if set to true, the server will include ISP info with the IP address
@@ -185,6 +187,7 @@ this.addEventListener("message", function (e) {
 			if (testState == 5) return;
 			if (test_pointer >= settings.test_order.length) {
 				//test is finished
+				wsClose();
 				if (settings.telemetry_level > 0)
 					sendTelemetry(function (id) {
 						testState = 4;
@@ -212,7 +215,7 @@ this.addEventListener("message", function (e) {
 							return;
 						} else dRun = true;
 						testState = 1;
-						dlTest(runNextTest);
+						wsOrXhr(wsDlTest, dlTest, runNextTest);
 					}
 					break;
 				case "U":
@@ -223,7 +226,7 @@ this.addEventListener("message", function (e) {
 							return;
 						} else uRun = true;
 						testState = 3;
-						ulTest(runNextTest);
+						wsOrXhr(wsUlTest, ulTest, runNextTest);
 					}
 					break;
 				case "P":
@@ -234,7 +237,7 @@ this.addEventListener("message", function (e) {
 							return;
 						} else pRun = true;
 						testState = 2;
-						pingTest(runNextTest);
+						wsOrXhr(wsPingTest, pingTest, runNextTest);
 					}
 					break;
 				case "_":
@@ -254,6 +257,7 @@ this.addEventListener("message", function (e) {
 		if (testState >= 4) return;
 		tlog("manually aborted");
 		clearRequests(); // stop all xhr activity
+		wsClose(); // stop WebSocket activity
 		runNextTest = null;
 		if (interval) clearInterval(interval); // clear timer if present
 		if (settings.telemetry_level > 1) sendTelemetry(function () { });
@@ -683,6 +687,259 @@ function pingTest(done) {
 	}.bind(this);
 	doPing(); // start first ping
 }
+// WebSocket tests, used instead of the XHR tests if settings.websocket is enabled
+let ws = null; // WebSocket connection shared by all tests
+let wsHandler = null; // receives the messages of the test currently running over ws, null if the connection was lost
+// runs wsTest over the WebSocket connection, or xhrTest if WebSockets are disabled or the connection cannot be opened
+function wsOrXhr(wsTest, xhrTest, done) {
+	if (!settings.websocket) {
+		xhrTest(done);
+		return;
+	}
+	wsConnect(function (ok) {
+		if (ok) wsTest(done);
+		else {
+			twarn("WebSocket connection failed, falling back to XHR");
+			settings.websocket = false;
+			xhrTest(done);
+		}
+	});
+}
+// opens the WebSocket connection unless it is already open, then calls done with true if it is usable
+function wsConnect(done) {
+	if (ws && ws.readyState === 1) {
+		done(true);
+		return;
+	}
+	let url;
+	try {
+		url = new URL(settings.url_ws + url_sep(settings.url_ws) + "r=" + Math.random(), self.location.href);
+		url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+		ws = new WebSocket(url.href);
+	} catch (e) {
+		done(false);
+		return;
+	}
+	const startT = new Date().getTime();
+	let opened = false;
+	ws.binaryType = "arraybuffer";
+	ws.onopen = function () {
+		opened = true;
+		tlog("WebSocket connected, took " + (new Date().getTime() - startT) + "ms");
+		done(true);
+	};
+	ws.onmessage = function (e) {
+		if (!wsHandler) return;
+		if (typeof e.data !== "string") {
+			wsHandler(null, e.data.byteLength);
+			return;
+		}
+		let msg;
+		try {
+			msg = JSON.parse(e.data);
+		} catch (ex) {
+			twarn("Invalid WebSocket message: " + e.data);
+			return;
+		}
+		if (msg.type === "error") twarn("WebSocket error: " + msg.message);
+		wsHandler(msg, 0);
+	};
+	ws.onclose = function (e) {
+		tverb("WebSocket closed " + e.code + " " + e.reason);
+		ws = null;
+		if (!opened) done(false);
+		else if (wsHandler) wsHandler(null, -1); // connection lost during a test
+	};
+}
+// closes the WebSocket connection, if open
+function wsClose() {
+	wsHandler = null;
+	if (ws) {
+		try {
+			ws.close();
+		} catch (e) { }
+		ws = null;
+	}
+}
+// stops a download or upload test over ws, reporting the speed measured by the client, and waits for the server's result
+function wsStop(test, status, done) {
+	wsHandler = function (msg, n) {
+		if (n < 0 || (msg && (msg.type === "error" || (msg.type === "result" && msg.test === test)))) {
+			if (msg && msg.type === "result") tlog(test + " measured by server: " + (msg.mbps || 0).toFixed(2) + " Mbit/s");
+			wsHandler = null;
+			done();
+		}
+	};
+	try {
+		ws.send(JSON.stringify({ type: "stop", mbps: isNaN(status) ? 0 : Number(status) }));
+	} catch (e) {
+		wsHandler = null;
+		done();
+	}
+}
+// download test over ws, calls done function when it's over
+function wsDlTest(done) {
+	tverb("wsDlTest");
+	if (dlCalled) return;
+	else dlCalled = true; // dlTest already called?
+	let totLoaded = 0.0, // total number of loaded bytes
+		startT = new Date().getTime(), // timestamp when test was started
+		bonusT = 0, //how many milliseconds the test has been shortened by (higher on faster connections)
+		graceTimeDone = false, //set to true after the grace time is past
+		failed = false; // set to true if the connection fails
+	wsHandler = function (msg, n) {
+		if (n < 0 || (msg && msg.type === "error")) failed = true;
+		else if (n > 0) totLoaded += n;
+	};
+	ws.send(JSON.stringify({ type: "download" }));
+	// every 200ms, update dlStatus
+	interval = setInterval(
+		function () {
+			tverb("DL: " + dlStatus + (graceTimeDone ? "" : " (in grace time)"));
+			const t = new Date().getTime() - startT;
+			if (graceTimeDone) dlProgress = (t + bonusT) / (settings.time_dl_max * 1000);
+			if (t < 200 && !failed) return;
+			if (!graceTimeDone && !failed) {
+				if (t > 1000 * settings.time_dlGraceTime) {
+					if (totLoaded > 0) {
+						// if the connection is so slow that we didn't get a single chunk yet, do not reset
+						startT = new Date().getTime();
+						bonusT = 0;
+						totLoaded = 0.0;
+					}
+					graceTimeDone = true;
+				}
+			} else {
+				const speed = totLoaded / (t / 1000.0);
+				if (settings.time_auto) {
+					//decide how much to shorten the test. Every 200ms, the test is shortened by the bonusT calculated here
+					const bonus = (5.0 * speed) / 100000;
+					bonusT += bonus > 400 ? 400 : bonus;
+				}
+				//update status
+				dlStatus = ((speed * 8 * settings.overheadCompensationFactor) / (settings.useMebibits ? 1048576 : 1000000)).toFixed(2);
+				if ((t + bonusT) / 1000.0 > settings.time_dl_max || failed) {
+					// test is over, stop the server and timer
+					if (failed || isNaN(dlStatus)) dlStatus = "Fail";
+					clearInterval(interval);
+					dlProgress = 1;
+					tlog("dlTest: " + dlStatus + ", took " + (new Date().getTime() - startT) + "ms");
+					if (failed) {
+						wsHandler = null;
+						done();
+					} else wsStop("download", dlStatus, done);
+				}
+			}
+		}.bind(this),
+		200
+	);
+}
+// upload test over ws, calls done function when it's over
+function wsUlTest(done) {
+	tverb("wsUlTest");
+	if (ulCalled) return;
+	else ulCalled = true; // ulTest already called?
+	// garbage data for upload test
+	let r = new ArrayBuffer(1048576);
+	const maxInt = Math.pow(2, 32) - 1;
+	try {
+		r = new Uint32Array(r);
+		for (let i = 0; i < r.length; i++) r[i] = Math.random() * maxInt;
+	} catch (e) { }
+	let totSent = 0.0, // total number of bytes passed to ws.send
+		startT = new Date().getTime(), // timestamp when test was started
+		bonusT = 0, //how many milliseconds the test has been shortened by (higher on faster connections)
+		graceTimeDone = false, //set to true after the grace time is past
+		failed = false; // set to true if the connection fails
+	wsHandler = function (msg, n) {
+		if (n < 0 || (msg && msg.type === "error")) failed = true;
+	};
+	ws.send(JSON.stringify({ type: "upload" }));
+	// keep up to 8 megabytes queued in the WebSocket, the bytes still in the queue have not been transmitted yet
+	const fill = setInterval(function () {
+		if (failed || !ws) return;
+		try {
+			while (ws.bufferedAmount < 8388608) {
+				ws.send(r);
+				totSent += r.byteLength;
+			}
+		} catch (e) {
+			failed = true;
+		}
+	}, 10);
+	const totLoaded = function () {
+		return ws ? totSent - ws.bufferedAmount : 0;
+	};
+	let offset = 0; // bytes transmitted during the grace time
+	// every 200ms, update ulStatus
+	interval = setInterval(
+		function () {
+			tverb("UL: " + ulStatus + (graceTimeDone ? "" : " (in grace time)"));
+			const t = new Date().getTime() - startT;
+			if (graceTimeDone) ulProgress = (t + bonusT) / (settings.time_ul_max * 1000);
+			if (t < 200 && !failed) return;
+			if (!graceTimeDone && !failed) {
+				if (t > 1000 * settings.time_ulGraceTime) {
+					if (totLoaded() > 0) {
+						// if the connection is so slow that we didn't get a single chunk yet, do not reset
+						startT = new Date().getTime();
+						bonusT = 0;
+						offset = totLoaded();
+					}
+					graceTimeDone = true;
+				}
+			} else {
+				const speed = (totLoaded() - offset) / (t / 1000.0);
+				if (settings.time_auto) {
+					//decide how much to shorten the test. Every 200ms, the test is shortened by the bonusT calculated here
+					const bonus = (5.0 * speed) / 100000;
+					bonusT += bonus > 400 ? 400 : bonus;
+				}
+				//update status
+				ulStatus = ((speed * 8 * settings.overheadCompensationFactor) / (settings.useMebibits ? 1048576 : 1000000)).toFixed(2);
+				if ((t + bonusT) / 1000.0 > settings.time_ul_max || failed) {
+					// test is over, stop sending data and timer
+					if (failed || isNaN(ulStatus)) ulStatus = "Fail";
+					clearInterval(fill);
+					clearInterval(interval);
+					ulProgress = 1;
+					tlog("ulTest: " + ulStatus + ", took " + (new Date().getTime() - startT) + "ms");
+					if (failed) {
+						wsHandler = null;
+						done();
+					} else wsStop("upload", ulStatus, done);
+				}
+			}
+		}.bind(this),
+		200
+	);
+}
+// ping+jitter test over ws, measured by the server with WebSocket ping frames. function done is called when it's over
+function wsPingTest(done) {
+	tverb("wsPingTest");
+	if (ptCalled) return;
+	else ptCalled = true; // pingTest already called?
+	const startT = new Date().getTime(); //when the test was started
+	wsHandler = function (msg, n) {
+		if (n < 0 || (msg && msg.type === "error")) {
+			pingStatus = "Fail";
+			jitterStatus = "Fail";
+		} else if (!msg) return;
+		else if (msg.type === "ping") {
+			tverb("pong " + msg.seq + " " + msg.rtt);
+			pingProgress = msg.seq / settings.count_ping;
+			return;
+		} else if (msg.type === "result" && msg.test === "ping") {
+			pingStatus = msg.count > 0 ? (msg.ping || 0).toFixed(2) : "Fail";
+			jitterStatus = msg.count > 0 ? (msg.jitter || 0).toFixed(2) : "Fail";
+		} else return;
+		wsHandler = null;
+		pingProgress = 1;
+		tlog("ping: " + pingStatus + " jitter: " + jitterStatus + ", took " + (new Date().getTime() - startT) + "ms");
+		done();
+	};
+	ws.send(JSON.stringify({ type: "ping", count: settings.count_ping }));
+}
 // telemetry
 function sendTelemetry(done) {
 	if (settings.telemetry_level < 1) return;
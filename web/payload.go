@@ -0,0 +1,78 @@
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/config"
+)
+
+var (
+	// chunkSize is the size of the chunks the download test is sent in
+	chunkSize = 1048576
+	// defaultChunks and maxChunks are the number of chunks sent if ckSize is missing, and the most that can be requested
+	defaultChunks = 4
+	maxChunks     = 1024
+
+	// generators are reused across requests, every generator continues its own keystream
+	generators = sync.Pool{New: func() any { return newGenerator() }}
+)
+
+// generator produces the download test data from an AES-CTR keystream. The data is incompressible and never
+// repeats, so that middleboxes cannot deduplicate or compress it
+type generator struct {
+	stream cipher.Stream
+	buf    []byte
+}
+
+// initializePayload 根据配置设置下载测试的数据块大小和数量
+func initializePayload(conf *config.Config) {
+	if conf.DownloadChunkSize <= 0 || conf.DownloadMaxChunks <= 0 {
+		log.Fatal("download_chunk_size and download_max_chunks must be positive")
+	}
+	chunkSize = conf.DownloadChunkSize
+	maxChunks = conf.DownloadMaxChunks
+	defaultChunks = min(max(conf.DownloadChunks, 1), maxChunks)
+}
+
+// newGenerator 使用随机的密钥和 IV 创建一个生成器
+func newGenerator() *generator {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate random data: %s", err)
+	}
+	if _, err := rand.Read(iv); err != nil {
+		log.Fatalf("Failed to generate random data: %s", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatalf("Failed to create cipher: %s", err)
+	}
+	return &generator{stream: cipher.NewCTR(block, iv)}
+}
+
+// getGenerator 从池中取出一个生成器，用完后需要调用 release
+func getGenerator() *generator {
+	g := generators.Get().(*generator)
+	if len(g.buf) != chunkSize {
+		g.buf = make([]byte, chunkSize)
+	}
+	return g
+}
+
+func (g *generator) release() {
+	generators.Put(g)
+}
+
+// next 返回下一个数据块，内容在下一次调用前有效。
+// 密钥流与上一个数据块异或后仍然是伪随机的，因此不需要先清零缓冲区
+func (g *generator) next() []byte {
+	g.stream.XORKeyStream(g.buf, g.buf)
+	return g.buf
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"speedtest/clientip"
+	"speedtest/quota"
+)
+
+// enforceQuota 拒绝已经用完每日或每月流量配额的客户端，并将测试传输的字节计入配额
+func enforceQuota(c *gin.Context) {
+	if !quota.Enabled() {
+		c.Next()
+		return
+	}
+
+	addr := clientip.FromRequest(c.Request)
+	if !addr.IsValid() {
+		c.Next()
+		return
+	}
+	key := quota.Key(addr)
+
+	if ok, wait := quota.Check(key); !ok {
+		rateLimited.WithLabelValues("quota").Inc()
+		tooManyRequests(c, wait)
+		return
+	}
+
+	meteredTransfer(c).limit(func(n int) (bool, time.Duration) {
+		ok, wait := quota.Take(key, int64(n))
+		if !ok {
+			rateLimited.WithLabelValues("quota").Inc()
+		}
+		return ok, wait
+	})
+
+	c.Next()
+}
+
+// quotaStatus 处理对/quota的请求，返回客户端的流量配额使用情况
+func quotaStatus(c *gin.Context) {
+	if !quota.Enabled() {
+		c.JSON(http.StatusOK, quota.Status{})
+		return
+	}
+
+	addr := clientip.FromRequest(c.Request)
+	if !addr.IsValid() {
+		c.JSON(http.StatusOK, quota.Status{})
+		return
+	}
+
+	c.JSON(http.StatusOK, quota.ClientStatus(quota.Key(addr)))
+}
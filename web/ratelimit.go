@@ -0,0 +1,90 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/clientip"
+	"speedtest/config"
+	"speedtest/ratelimit"
+)
+
+var (
+	// testLimiter and byteLimiter are nil when the respective limit is disabled
+	testLimiter *ratelimit.Limiter
+	byteLimiter *ratelimit.Limiter
+	ipv6Prefix  int
+
+	limitDownloads = rateLimit(func(*http.Request) bool { return true })
+	// /empty also answers the ping test, only uploads count as test streams
+	limitUploads = rateLimit(func(r *http.Request) bool { return r.Method == http.MethodPost })
+)
+
+// initializeRateLimit 根据配置创建测试次数和流量的限速器
+func initializeRateLimit(conf *config.Config) {
+	ipv6Prefix = conf.RateLimitIPv6Prefix
+
+	if conf.RateLimitTestsPerMinute > 0 {
+		testLimiter = ratelimit.New(conf.RateLimitTestsPerMinute/60, float64(max(conf.RateLimitTestsBurst, 1)))
+		log.Infof("Limiting clients to %g test streams per minute, bursts of %d", conf.RateLimitTestsPerMinute, conf.RateLimitTestsBurst)
+	}
+	if conf.RateLimitBytesPerSecond > 0 {
+		byteLimiter = ratelimit.New(float64(conf.RateLimitBytesPerSecond), float64(max(conf.RateLimitBytesBurst, int64(chunkSize))))
+		log.Infof("Limiting clients to %d bytes per second, bursts of %d bytes", conf.RateLimitBytesPerSecond, conf.RateLimitBytesBurst)
+	}
+}
+
+// rateLimit 返回限制每个客户端开始测试的频率和传输数据量的中间件，超出限制时返回 429。
+// isTest 判断请求是否计入测试次数，已经开始的测试在流量耗尽时中断
+func rateLimit(isTest func(*http.Request) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if testLimiter == nil && byteLimiter == nil {
+			c.Next()
+			return
+		}
+
+		addr := clientip.FromRequest(c.Request)
+		if !addr.IsValid() {
+			c.Next()
+			return
+		}
+		key := ratelimit.Key(addr, 0, ipv6Prefix)
+
+		if testLimiter != nil && isTest(c.Request) {
+			if ok, wait := testLimiter.Allow(key, 1); !ok {
+				rateLimited.WithLabelValues("tests").Inc()
+				tooManyRequests(c, wait)
+				return
+			}
+		}
+
+		if byteLimiter != nil {
+			if ok, wait := byteLimiter.Consume(key, 0); !ok {
+				rateLimited.WithLabelValues("bytes").Inc()
+				tooManyRequests(c, wait)
+				return
+			}
+
+			meteredTransfer(c).limit(func(n int) (bool, time.Duration) {
+				ok, wait := byteLimiter.Consume(key, float64(n))
+				if !ok {
+					rateLimited.WithLabelValues("bytes").Inc()
+				}
+				return ok, wait
+			})
+		}
+
+		c.Next()
+	}
+}
+
+// tooManyRequests 拒绝请求并通过 Retry-After 告知客户端需要等待的秒数
+func tooManyRequests(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+	c.AbortWithStatus(http.StatusTooManyRequests)
+}
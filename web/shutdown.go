@@ -0,0 +1,54 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// draining is set once shutdown has started, new test streams are rejected from then on
+	draining atomic.Bool
+)
+
+// acceptNewStreams 在服务器关闭期间拒绝新的 /garbage 和 /empty 测试流，已经开始的测试不受影响
+func acceptNewStreams(c *gin.Context) {
+	if draining.Load() {
+		c.Header("Connection", "close")
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	c.Next()
+}
+
+const (
+	// retryAfterSeconds is sent to clients starting a test while the server is shutting down
+	retryAfterSeconds = 30
+)
+
+// shutdown 停止接受新的测试并等待正在进行的请求完成，超过 gracePeriod 后强制关闭剩余连接
+func shutdown(srv *http.Server, gracePeriod time.Duration) error {
+	draining.Store(true)
+	log.Infof("Shutting down, waiting up to %s for running tests to finish", gracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warnf("Grace period expired before all tests finished, closing remaining connections: %s", err)
+		closeWebSockets(ctx)
+		return srv.Close()
+	}
+	if err := closeWebSockets(ctx); err != nil {
+		log.Warnf("Grace period expired before all WebSocket tests finished, closing remaining connections: %s", err)
+	}
+
+	log.Info("All running tests finished")
+	return nil
+}
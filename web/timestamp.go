@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// timeEcho holds the timestamps of a clock offset measurement as Unix time in milliseconds with microsecond
+// precision. With the time the client received the answer, t3, the offset of the server clock is
+// ((server_receive - client_send) + (server_send - t3)) / 2, and the one-way delays are
+// server_receive - client_send - offset upstream and t3 - server_send + offset downstream
+type timeEcho struct {
+	// ClientSend is the client's timestamp from the request, echoed unchanged
+	ClientSend    *float64 `json:"client_send,omitempty"`
+	ServerReceive float64  `json:"server_receive"`
+	ServerSend    float64  `json:"server_send"`
+}
+
+// timestamp 处理对/time的请求，返回服务器接收和发送响应的时间，客户端可以据此估算时钟偏差和单向延迟。
+// 客户端发送请求的时间可以通过参数 t 传入，并原样返回
+func timestamp(c *gin.Context) {
+	received := time.Now()
+
+	var echo timeEcho
+	if t := c.Query("t"); t != "" {
+		clientSend, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid t value")
+			return
+		}
+		echo.ClientSend = &clientSend
+	}
+
+	c.Header("Cache-Control", "no-store")
+	echo.ServerReceive = unixMillis(received)
+	echo.ServerSend = unixMillis(time.Now())
+	c.JSON(http.StatusOK, echo)
+}
+
+// unixMillis 返回毫秒为单位的 Unix 时间，精确到微秒
+func unixMillis(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e3
+}
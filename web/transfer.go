@@ -0,0 +1,94 @@
+package web
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// transferKey stores the *transfer of a request in the gin context
+	transferKey = "speedtest.transfer"
+)
+
+var (
+	errTransferLimit = errors.New("transfer limit exceeded")
+)
+
+// transfer takes the bytes of a single download or upload request from the limits of the client
+type transfer struct {
+	limits []func(n int) (bool, time.Duration)
+	// wait is set once a limit has stopped the transfer
+	wait time.Duration
+}
+
+// meteredTransfer 返回请求的 transfer，第一次调用时包装响应和请求体以便计入传输的字节数
+func meteredTransfer(c *gin.Context) *transfer {
+	if v, ok := c.Get(transferKey); ok {
+		return v.(*transfer)
+	}
+
+	t := &transfer{}
+	c.Writer = &meteredWriter{ResponseWriter: c.Writer, transfer: t}
+	c.Request.Body = &meteredReader{ReadCloser: c.Request.Body, transfer: t}
+	c.Set(transferKey, t)
+	return t
+}
+
+// limit 添加一个限制，take 在超出限制时返回 false 和需要等待的时间
+func (t *transfer) limit(take func(n int) (bool, time.Duration)) {
+	t.limits = append(t.limits, take)
+}
+
+func (t *transfer) take(n int) error {
+	for _, take := range t.limits {
+		if ok, wait := take(n); !ok {
+			t.wait = wait
+			return errTransferLimit
+		}
+	}
+	return nil
+}
+
+type meteredWriter struct {
+	gin.ResponseWriter
+	transfer *transfer
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	if err := w.transfer.take(len(p)); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+type meteredReader struct {
+	io.ReadCloser
+	transfer *transfer
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if lerr := r.transfer.take(n); lerr != nil {
+			return n, lerr
+		}
+	}
+	return n, err
+}
+
+// stoppedTransfer 在请求因为超出限制而中断时返回 true 并以 429 拒绝请求
+func stoppedTransfer(c *gin.Context) bool {
+	v, ok := c.Get(transferKey)
+	if !ok {
+		return false
+	}
+	t := v.(*transfer)
+	if t.wait == 0 {
+		return false
+	}
+	tooManyRequests(c, t.wait)
+	return true
+}
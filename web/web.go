@@ -1,27 +1,29 @@
 package web
 
 import (
+	"context"
 	"embed"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"net"
 	"net/http"
-	"regexp"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 
+	"speedtest/clientip"
 	"speedtest/config"
+	"speedtest/ipclass"
 	"speedtest/results"
-)
-
-const (
-	// chunk size is 1 MiB
-	chunkSize = 1048576
+	"speedtest/servers"
+	"speedtest/session"
 )
 
 var (
@@ -29,16 +31,53 @@ var (
 	assetsFS embed.FS
 )
 
-var (
-	// generate random data for download test on start to minimize runtime overhead
-	randomData = getRandomData(chunkSize)
-)
-
-// ListenAndServe 启动HTTP服务器并设置路由处理程序
-func ListenAndServe(conf *config.Config) error {
+// ListenAndServe 启动HTTP服务器并设置路由处理程序，ctx 取消后平滑关闭服务器
+func ListenAndServe(ctx context.Context, conf *config.Config) error {
 	gin.SetMode(gin.DebugMode)
+	r, err := newRouter(conf)
+	if err != nil {
+		return err
+	}
+
+	initializePayload(conf)
+	initializeTestFiles(conf)
+	initializeRateLimit(conf)
+
+	srv, err := newServer(conf, r)
+	if err != nil {
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- GinRoute(conf, srv)
+	}()
+	if conf.ProxyProtocolPort != "0" {
+		go func() {
+			errc <- listenProxyProtocol(conf, srv)
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	return shutdown(srv, conf.ShutdownGracePeriod)
+}
+
+// newRouter 创建 gin 引擎并注册所有路由
+func newRouter(conf *config.Config) (*gin.Engine, error) {
 	r := gin.Default()
-	r.UseH2C = true
+	// client addresses are resolved by clientip with the trusted_proxies setting
+	if err := r.SetTrustedProxies(nil); err != nil {
+		return nil, err
+	}
+
+	if conf.EnableMetrics {
+		r.Use(countRequests)
+	}
 
 	// CORS
 	r.Use(cors.New(cors.Config{
@@ -51,18 +90,38 @@ func ListenAndServe(conf *config.Config) error {
 	r.POST(backendUrl+"/results/telemetry", results.Record)
 	r.GET(backendUrl+"/results", results.DrawPNG)
 	r.GET(backendUrl+"/getIP", getIP)
-	r.GET(backendUrl+"/garbage", garbage)
-	r.Any(backendUrl+"/empty", empty)
+	r.GET(backendUrl+"/time", timestamp)
+	r.GET(backendUrl+"/quota", quotaStatus)
+	r.GET(backendUrl+"/servers", serverList)
+	r.GET(backendUrl+"/garbage", acceptNewStreams, limitDownloads, enforceQuota, garbage)
+	r.Any(backendUrl+"/empty", acceptNewStreams, limitUploads, enforceQuota, empty)
+	r.GET(backendUrl+"/files/:name", acceptNewStreams, limitDownloads, enforceQuota, testFile)
+	r.HEAD(backendUrl+"/files/:name", acceptNewStreams, limitDownloads, enforceQuota, testFile)
+	r.GET(backendUrl+"/ws", acceptNewStreams, limitDownloads, enforceQuota, websocketTest)
+	r.Any(backendUrl+"/stats", results.Stats)
+	r.GET(backendUrl+"/stats/api", results.StatsAPI)
 
 	r.POST(conf.BaseURL+"/results/telemetry", results.Record)
 	r.GET(conf.BaseURL+"/results", results.DrawPNG)
 	r.GET(conf.BaseURL+"/getIP", getIP)
-	r.GET(conf.BaseURL+"/garbage", garbage)
-	r.Any(conf.BaseURL+"/empty", empty)
+	r.GET(conf.BaseURL+"/time", timestamp)
+	r.GET(conf.BaseURL+"/quota", quotaStatus)
+	r.GET(conf.BaseURL+"/servers", serverList)
+	r.GET(conf.BaseURL+"/garbage", acceptNewStreams, limitDownloads, enforceQuota, garbage)
+	r.Any(conf.BaseURL+"/empty", acceptNewStreams, limitUploads, enforceQuota, empty)
+	r.GET(conf.BaseURL+"/files/:name", acceptNewStreams, limitDownloads, enforceQuota, testFile)
+	r.HEAD(conf.BaseURL+"/files/:name", acceptNewStreams, limitDownloads, enforceQuota, testFile)
+	r.GET(conf.BaseURL+"/ws", acceptNewStreams, limitDownloads, enforceQuota, websocketTest)
+	r.Any(conf.BaseURL+"/stats", results.Stats)
+	r.GET(conf.BaseURL+"/stats/api", results.StatsAPI)
+
+	if conf.EnableMetrics {
+		r.GET(conf.BaseURL+"/metrics", gin.WrapH(promhttp.Handler()))
+	}
 
 	// PHP frontend default values compatibility
-	r.Any(conf.BaseURL+"/empty.php", empty)
-	r.GET(conf.BaseURL+"/garbage.php", garbage)
+	r.Any(conf.BaseURL+"/empty.php", acceptNewStreams, limitUploads, enforceQuota, empty)
+	r.GET(conf.BaseURL+"/garbage.php", acceptNewStreams, limitDownloads, enforceQuota, garbage)
 	r.GET(conf.BaseURL+"/getIP.php", getIP)
 	r.POST(conf.BaseURL+"/results/telemetry.php", results.Record)
 	r.GET(conf.BaseURL+"/results.php", results.DrawPNG)
@@ -74,37 +133,87 @@ func ListenAndServe(conf *config.Config) error {
 	}
 	r.NoRoute(gin.WrapH(http.FileServer(http.FS(pages))))
 
-	go listenProxyProtocol(conf, r)
-
-	//return startListener(conf, r)
-	return GinRoute(conf, r)
+	return r, nil
 }
 
 // listenProxyProtocol 启动一个监听Proxy Protocol的HTTP服务器
-func listenProxyProtocol(conf *config.Config, r *gin.Engine) {
-	if conf.ProxyProtocolPort != "0" {
-		addr := net.JoinHostPort(conf.BindAddress, conf.ProxyProtocolPort)
-		l, err := net.Listen("tcp", addr)
-		if err != nil {
-			log.Fatalf("Cannot listen on proxy protocol port %s: %s", conf.ProxyProtocolPort, err)
-		}
+func listenProxyProtocol(conf *config.Config, srv *http.Server) error {
+	addr := net.JoinHostPort(conf.BindAddress, conf.ProxyProtocolPort)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on proxy protocol port %s: %w", conf.ProxyProtocolPort, err)
+	}
 
-		pl := &proxyproto.Listener{Listener: l}
-		defer pl.Close()
+	pl := &proxyproto.Listener{Listener: l, ConnPolicy: clientip.ProxyPolicy}
+	defer pl.Close()
 
-		log.Infof("Starting proxy protocol listener on %s", addr)
-		log.Fatal(http.Serve(pl, r))
+	if !clientip.HasTrustedProxies() {
+		log.Warn("Accepting PROXY protocol headers from any peer, set trusted_proxies to restrict them")
 	}
+	log.Infof("Starting proxy protocol listener on %s", addr)
+	return serve(conf, srv, pl)
 }
 
-// empty 处理对/empty的请求，丢弃请求体并返回成功的状态码
+// uploadReport is returned by /empty with ?report=true, describing the upload as seen by the server
+type uploadReport struct {
+	Bytes     int64      `json:"bytes"`
+	FirstByte *time.Time `json:"first_byte,omitempty"`
+	LastByte  *time.Time `json:"last_byte,omitempty"`
+	// Seconds and Mbps are measured between the first and the last byte
+	Seconds  float64 `json:"seconds"`
+	Mbps     float64 `json:"mbps"`
+	Protocol string  `json:"protocol"`
+}
+
+// empty 处理对/empty的请求，丢弃请求体并返回成功的状态码，带有 report=true 时返回服务器接收到的数据统计
 func empty(c *gin.Context) {
-	_, err := io.Copy(io.Discard, c.Request.Body)
+	activeStreams.WithLabelValues("empty").Inc()
+	defer activeStreams.WithLabelValues("empty").Dec()
+
+	body := &timedReader{ReadCloser: c.Request.Body}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, body)
+	emptyBytes.Add(float64(n))
+	session.AddStream(clientip.ClientIP(c.Request), session.Upload, start, time.Now(), n)
 	if err != nil {
+		if stoppedTransfer(c) {
+			return
+		}
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	c.Status(http.StatusOK)
+
+	if c.Query("report") != "true" {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	report := uploadReport{Bytes: n, Protocol: c.Request.Proto}
+	if n > 0 {
+		report.FirstByte, report.LastByte = &body.first, &body.last
+		if d := body.last.Sub(body.first); d > 0 {
+			report.Seconds = d.Seconds()
+			report.Mbps = float64(n) * 8 / 1e6 / d.Seconds()
+		}
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// timedReader records when the first and the last bytes were read
+type timedReader struct {
+	io.ReadCloser
+	first, last time.Time
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.last = time.Now()
+		if r.first.IsZero() {
+			r.first = r.last
+		}
+	}
+	return n, err
 }
 
 // garbage 处理对/garbage的请求，返回指定数量的随机数据块
@@ -114,8 +223,7 @@ func garbage(c *gin.Context) {
 	c.Header("Content-Disposition", "attachment; filename=random.dat")
 	c.Header("Content-Transfer-Encoding", "binary")
 
-	// chunk size set to 4 by default
-	chunks := 4
+	chunks := defaultChunks
 
 	ckSize := c.Query("ckSize")
 	if ckSize != "" {
@@ -124,49 +232,64 @@ func garbage(c *gin.Context) {
 			log.Errorf("Invalid chunk size: %s", ckSize)
 			log.Warnf("Will use default value %d", chunks)
 		} else {
-			// limit max chunk size to 1024
-			if i > 1024 {
-				chunks = 1024
+			// limit max chunk size to download_max_chunks
+			if i > int64(maxChunks) {
+				chunks = maxChunks
 			} else {
 				chunks = int(i)
 			}
 		}
 	}
 
+	activeStreams.WithLabelValues("garbage").Inc()
+	defer activeStreams.WithLabelValues("garbage").Dec()
+
+	g := getGenerator()
+	defer g.release()
+
+	var written int64
+	start := time.Now()
+	defer func() {
+		session.AddStream(clientip.ClientIP(c.Request), session.Download, start, time.Now(), written)
+	}()
+
 	for i := 0; i < chunks; i++ {
-		if _, err := c.Writer.Write(randomData); err != nil {
+		n, err := c.Writer.Write(g.next())
+		garbageBytes.Add(float64(n))
+		written += int64(n)
+		if errors.Is(err, errTransferLimit) {
+			if i == 0 {
+				stoppedTransfer(c)
+			}
+			break
+		}
+		if err != nil {
 			log.Errorf("Error writing back to client at chunk number %d: %s", i, err)
 			break
 		}
 	}
 }
 
+// serverList 处理对/servers的请求，返回健康的服务器列表，没有配置服务器时返回 404
+func serverList(c *gin.Context) {
+	if !servers.Enabled() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, servers.List())
+}
+
 // getIP 处理对/getIP的请求，返回客户端IP地址及其相关信息
 func getIP(c *gin.Context) {
 	var ret results.Result
 
-	clientIP := c.ClientIP()
-
-	isSpecialIP := true
-	switch {
-	case clientIP == "::1":
-		ret.ProcessedString = clientIP + " - localhost IPv6 access"
-	case strings.HasPrefix(clientIP, "fe80:"):
-		ret.ProcessedString = clientIP + " - link-local IPv6 access"
-	case strings.HasPrefix(clientIP, "127."):
-		ret.ProcessedString = clientIP + " - localhost IPv4 access"
-	case strings.HasPrefix(clientIP, "10."):
-		ret.ProcessedString = clientIP + " - private IPv4 access"
-	case regexp.MustCompile(`^172\.(1[6-9]|2\d|3[01])\.`).MatchString(clientIP):
-		ret.ProcessedString = clientIP + " - private IPv4 access"
-	case strings.HasPrefix(clientIP, "192.168"):
-		ret.ProcessedString = clientIP + " - private IPv4 access"
-	case strings.HasPrefix(clientIP, "169.254"):
-		ret.ProcessedString = clientIP + " - link-local IPv4 access"
-	case regexp.MustCompile(`^100\.([6-9][0-9]|1[0-2][0-7])\.`).MatchString(clientIP):
-		ret.ProcessedString = clientIP + " - CGNAT IPv4 access"
-	default:
-		isSpecialIP = false
+	clientIP := clientip.ClientIP(c.Request)
+
+	ret.ProcessedString = clientIP
+	label, isSpecialIP := ipclass.Classify(clientIP)
+	if label != "" {
+		ret.ProcessedString += " - " + label
 	}
 
 	if isSpecialIP {
@@ -177,14 +300,12 @@ func getIP(c *gin.Context) {
 	getISPInfo := c.Query("isp") == "true"
 	distanceUnit := c.Query("distance")
 
-	ret.ProcessedString = clientIP
-
-	if getISPInfo {
-		ispInfo := getIPInfo(clientIP)
+	// an empty address would look up the server's own address, e.g. for clients connected over a unix socket
+	if getISPInfo && clientIP != "" {
+		ispInfo := getIPInfo(c.Request.Context(), clientIP)
 		ret.RawISPInfo = ispInfo
 
-		removeRegexp := regexp.MustCompile(`AS\d+\s`)
-		isp := removeRegexp.ReplaceAllString(ispInfo.Organization, "")
+		isp := ispInfo.ISPName()
 
 		if isp == "" {
 			isp = "Unknown ISP"
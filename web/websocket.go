@@ -0,0 +1,495 @@
+package web
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"speedtest/clientip"
+	"speedtest/session"
+)
+
+const (
+	// wsFrameSize is the size of the binary messages sent in the download test
+	wsFrameSize = 65536
+	// wsMaxMessageSize limits the binary messages clients send in the upload test
+	wsMaxMessageSize = 4 * 1048576
+	// wsMaxTestDuration ends a download or upload test the client did not stop in time
+	wsMaxTestDuration = 30 * time.Second
+	// wsPingTimeout is how long to wait for the pong of a single ping
+	wsPingTimeout = 2 * time.Second
+	// wsMaxPings limits the number of pings a client can request at once
+	wsMaxPings = 100
+	// wsIdleTimeout closes connections the client stopped using
+	wsIdleTimeout = time.Minute
+	// wsWriteTimeout bounds writing a single message
+	wsWriteTimeout = 10 * time.Second
+)
+
+// wsMessage is a control message exchanged as JSON text messages. Clients send the types download, upload,
+// ping, time and stop, the server answers with ping for every sample, result after every test, time and error
+type wsMessage struct {
+	Type string `json:"type"`
+	// Test is the test a result belongs to
+	Test string `json:"test,omitempty"`
+	// Count is the number of pings requested by the client
+	Count int `json:"count,omitempty"`
+	// Seq and RTT describe a single ping sample
+	Seq int     `json:"seq,omitempty"`
+	RTT float64 `json:"rtt,omitempty"`
+	// Ping and Jitter are the results of the ping test in milliseconds
+	Ping   float64 `json:"ping,omitempty"`
+	Jitter float64 `json:"jitter,omitempty"`
+	// Bytes, Seconds and Mbps are the results of the download and upload tests as measured by the sender
+	Bytes   int64   `json:"bytes,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+	Mbps    float64 `json:"mbps,omitempty"`
+	// ClientMbps is the throughput the client reported with stop
+	ClientMbps float64 `json:"client_mbps,omitempty"`
+	Message    string  `json:"message,omitempty"`
+	RetryAfter int     `json:"retry_after,omitempty"`
+	// T is the client's timestamp in a time request, answered with the timestamps of the server
+	T *float64 `json:"t,omitempty"`
+	*timeEcho
+}
+
+// wsEvent is passed from the reading goroutine to the handler
+type wsEvent struct {
+	msg *wsMessage
+	// bytes is the size of a binary message
+	bytes int64
+	// pong carries the sequence number and round-trip time of a received pong
+	pong bool
+	seq  int
+	rtt  time.Duration
+	at   time.Time
+	err  error
+}
+
+var (
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  wsFrameSize,
+		WriteBufferSize: wsFrameSize,
+		// the test endpoints allow all origins, just like the CORS settings
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+
+	// webSockets tracks open connections, they are hijacked and not closed by http.Server.Shutdown
+	webSockets = struct {
+		sync.Mutex
+		wg    sync.WaitGroup
+		conns map[*websocket.Conn]struct{}
+		// closing is closed once shutdown waits for the connections, idle connections are closed then
+		closing chan struct{}
+	}{conns: make(map[*websocket.Conn]struct{}), closing: make(chan struct{})}
+)
+
+// websocketTest 处理对/ws的请求，在同一个 WebSocket 连接上进行下载、上传和延迟测试。
+// 延迟由服务器发送带时间戳的 ping 帧测量，下载和上传的速度由双方分别测量并告知对方
+func websocketTest(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader already responded with an error
+		log.Debugf("WebSocket upgrade failed: %s", err)
+		return
+	}
+
+	webSockets.Lock()
+	if draining.Load() {
+		webSockets.Unlock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"), time.Now().Add(wsWriteTimeout))
+		conn.Close()
+		return
+	}
+	webSockets.conns[conn] = struct{}{}
+	webSockets.wg.Add(1)
+	webSockets.Unlock()
+	defer func() {
+		webSockets.Lock()
+		delete(webSockets.conns, conn)
+		webSockets.Unlock()
+		conn.Close()
+		webSockets.wg.Done()
+	}()
+
+	activeStreams.WithLabelValues("websocket").Inc()
+	defer activeStreams.WithLabelValues("websocket").Dec()
+
+	t := &wsTest{
+		conn:   conn,
+		client: clientip.ClientIP(c.Request),
+		events: make(chan wsEvent, 16),
+		epoch:  time.Now(),
+	}
+	if v, ok := c.Get(transferKey); ok {
+		t.transfer = v.(*transfer)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go t.read(ctx)
+
+	if err := t.serve(); err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		log.Debugf("WebSocket test with %s ended: %s", t.client, err)
+	}
+}
+
+// wsTest holds the state of a single WebSocket connection
+type wsTest struct {
+	conn     *websocket.Conn
+	client   string
+	transfer *transfer
+	events   chan wsEvent
+	// epoch is the reference for the timestamps sent in pings
+	epoch time.Time
+}
+
+// read 持续读取客户端发送的消息并转交给 serve，pong 帧在这里计算往返时间
+func (t *wsTest) read(ctx context.Context) {
+	send := func(ev wsEvent) bool {
+		select {
+		case t.events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	t.conn.SetReadLimit(wsMaxMessageSize)
+	t.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+	t.conn.SetPongHandler(func(data string) error {
+		if len(data) != 16 {
+			return nil
+		}
+		seq := int(binary.BigEndian.Uint64([]byte(data[:8])))
+		sent := time.Duration(binary.BigEndian.Uint64([]byte(data[8:])))
+		send(wsEvent{pong: true, seq: seq, rtt: time.Since(t.epoch) - sent})
+		return nil
+	})
+
+	for {
+		typ, r, err := t.conn.NextReader()
+		if err != nil {
+			send(wsEvent{err: err})
+			return
+		}
+		t.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+
+		var ev wsEvent
+		switch typ {
+		case websocket.TextMessage:
+			var msg wsMessage
+			if err := readJSON(r, &msg); err != nil {
+				send(wsEvent{err: err})
+				return
+			}
+			ev.msg = &msg
+		case websocket.BinaryMessage:
+			n, err := io.Copy(io.Discard, r)
+			if err != nil {
+				send(wsEvent{err: err})
+				return
+			}
+			ev.bytes = n
+		}
+		ev.at = time.Now()
+		if !send(ev) {
+			return
+		}
+	}
+}
+
+// serve 依次执行客户端请求的测试，直到连接关闭
+func (t *wsTest) serve() error {
+	for {
+		var ev wsEvent
+		select {
+		case ev = <-t.events:
+		case <-webSockets.closing:
+			t.close(websocket.CloseGoingAway, "server is shutting down")
+			return nil
+		}
+		if ev.err != nil {
+			return ev.err
+		}
+		if ev.bytes > 0 {
+			// upload data arriving after the client stopped the test
+			if err := t.take(ev.bytes); err != nil {
+				return err
+			}
+			continue
+		}
+		if ev.msg == nil {
+			continue
+		}
+
+		var err error
+		switch ev.msg.Type {
+		case "download":
+			err = t.download()
+		case "upload":
+			err = t.upload(ev.at)
+		case "ping":
+			err = t.ping(ev.msg.Count)
+		case "time":
+			// the message was received when the reading goroutine got it, not when serve handles it
+			err = t.write(&wsMessage{Type: "time", timeEcho: &timeEcho{
+				ClientSend:    ev.msg.T,
+				ServerReceive: unixMillis(ev.at),
+				ServerSend:    unixMillis(time.Now()),
+			}})
+		case "stop":
+			// the test already ended on the server
+		default:
+			err = t.write(&wsMessage{Type: "error", Message: "unknown message type " + ev.msg.Type})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// download 不断发送二进制消息，直到客户端发送 stop 或超过最长测试时间
+func (t *wsTest) download() error {
+	g := getGenerator()
+	defer g.release()
+	var chunk []byte
+
+	var written int64
+	clientMbps := 0.0
+	start := time.Now()
+
+loop:
+	for time.Since(start) < wsMaxTestDuration {
+		select {
+		case ev := <-t.events:
+			if ev.err != nil {
+				return ev.err
+			}
+			if ev.msg != nil && ev.msg.Type == "stop" {
+				clientMbps = ev.msg.Mbps
+				break loop
+			}
+		default:
+		}
+
+		if len(chunk) == 0 {
+			chunk = g.next()
+		}
+		frame := chunk[:min(wsFrameSize, len(chunk))]
+		chunk = chunk[len(frame):]
+
+		if err := t.take(int64(len(frame))); err != nil {
+			return err
+		}
+		t.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := t.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return err
+		}
+		garbageBytes.Add(float64(len(frame)))
+		written += int64(len(frame))
+	}
+
+	end := time.Now()
+	session.AddStream(t.client, session.Download, start, end, written)
+	return t.result("download", written, end.Sub(start), clientMbps)
+}
+
+// upload 统计客户端发送的二进制消息，直到客户端发送 stop 或超过最长测试时间
+func (t *wsTest) upload(start time.Time) error {
+	var received int64
+	clientMbps := 0.0
+	end := start
+
+	timeout := time.NewTimer(wsMaxTestDuration)
+	defer timeout.Stop()
+
+loop:
+	for {
+		select {
+		case ev := <-t.events:
+			if ev.err != nil {
+				session.AddStream(t.client, session.Upload, start, end, received)
+				return ev.err
+			}
+			if ev.bytes > 0 {
+				if err := t.take(ev.bytes); err != nil {
+					return err
+				}
+				emptyBytes.Add(float64(ev.bytes))
+				received += ev.bytes
+				end = ev.at
+			}
+			if ev.msg != nil && ev.msg.Type == "stop" {
+				clientMbps = ev.msg.Mbps
+				break loop
+			}
+		case <-timeout.C:
+			break loop
+		}
+	}
+
+	session.AddStream(t.client, session.Upload, start, end, received)
+	return t.result("upload", received, end.Sub(start), clientMbps)
+}
+
+// ping 发送 count 个带序号和时间戳的 ping 帧，根据客户端返回的 pong 计算延迟和抖动
+func (t *wsTest) ping(count int) error {
+	count = min(max(count, 1), wsMaxPings)
+
+	var rtts []float64
+	for seq := 1; seq <= count; seq++ {
+		payload := make([]byte, 16)
+		binary.BigEndian.PutUint64(payload, uint64(seq))
+		binary.BigEndian.PutUint64(payload[8:], uint64(time.Since(t.epoch)))
+		if err := t.conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(wsWriteTimeout)); err != nil {
+			return err
+		}
+
+		timeout := time.NewTimer(wsPingTimeout)
+	wait:
+		for {
+			select {
+			case ev := <-t.events:
+				if ev.err != nil {
+					timeout.Stop()
+					return ev.err
+				}
+				if ev.bytes > 0 {
+					if err := t.take(ev.bytes); err != nil {
+						timeout.Stop()
+						return err
+					}
+				}
+				// pongs of pings that already timed out are ignored
+				if !ev.pong || ev.seq != seq {
+					continue
+				}
+				rtt := float64(ev.rtt) / float64(time.Millisecond)
+				rtts = append(rtts, rtt)
+				if err := t.write(&wsMessage{Type: "ping", Seq: seq, RTT: rtt}); err != nil {
+					timeout.Stop()
+					return err
+				}
+				break wait
+			case <-timeout.C:
+				log.Debugf("WebSocket ping %d to %s timed out", seq, t.client)
+				break wait
+			}
+		}
+		timeout.Stop()
+	}
+
+	ping, jitter := pingStats(rtts)
+	return t.write(&wsMessage{Type: "result", Test: "ping", Count: len(rtts), Ping: ping, Jitter: jitter})
+}
+
+// pingStats 计算最低延迟和抖动，抖动的计算方式与 speedtest_worker.js 相同，较大的变化权重更高
+func pingStats(rtts []float64) (ping, jitter float64) {
+	for i, rtt := range rtts {
+		if i == 0 {
+			ping = rtt
+			continue
+		}
+		ping = math.Min(ping, rtt)
+		d := math.Abs(rtt - rtts[i-1])
+		switch {
+		case i == 1:
+			jitter = d
+		case d > jitter:
+			jitter = jitter*0.3 + d*0.7
+		default:
+			jitter = jitter*0.8 + d*0.2
+		}
+	}
+	return ping, jitter
+}
+
+// result 将服务器测量的速度发送给客户端
+func (t *wsTest) result(test string, n int64, d time.Duration, clientMbps float64) error {
+	mbps := 0.0
+	if d > 0 {
+		mbps = float64(n) * 8 / 1e6 / d.Seconds()
+	}
+	log.Debugf("WebSocket %s test with %s: %d bytes in %s, %.2f Mbit/s measured by the server, %.2f Mbit/s by the client", test, t.client, n, d, mbps, clientMbps)
+
+	return t.write(&wsMessage{
+		Type:       "result",
+		Test:       test,
+		Bytes:      n,
+		Seconds:    d.Seconds(),
+		Mbps:       mbps,
+		ClientMbps: clientMbps,
+	})
+}
+
+// take 将传输的字节计入客户端的流量限制和配额，超出限制时通知客户端并关闭连接
+func (t *wsTest) take(n int64) error {
+	if t.transfer == nil {
+		return nil
+	}
+	if err := t.transfer.take(int(n)); err != nil {
+		retryAfter := int(math.Max(1, math.Ceil(t.transfer.wait.Seconds())))
+		t.write(&wsMessage{Type: "error", Message: err.Error(), RetryAfter: retryAfter})
+		t.close(websocket.CloseTryAgainLater, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (t *wsTest) write(msg *wsMessage) error {
+	t.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return t.conn.WriteJSON(msg)
+}
+
+func (t *wsTest) close(code int, reason string) {
+	t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+}
+
+// readJSON 解析文本消息，控制消息最多 4 KiB
+func readJSON(r io.Reader, v any) error {
+	data, err := io.ReadAll(io.LimitReader(r, 4096+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > 4096 {
+		return errors.New("control message too large")
+	}
+	return json.Unmarshal(data, v)
+}
+
+// closeWebSockets 等待 WebSocket 测试结束，ctx 取消后关闭剩余的连接
+func closeWebSockets(ctx context.Context) error {
+	webSockets.Lock()
+	close(webSockets.closing)
+	webSockets.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		webSockets.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	webSockets.Lock()
+	for conn := range webSockets.conns {
+		conn.Close()
+	}
+	webSockets.Unlock()
+	return ctx.Err()
+}